@@ -4,15 +4,16 @@ go 1.21
 
 require (
 	github.com/SovereignCloudStack/csctl v0.0.3
+	github.com/dustin/go-humanize v1.0.1
 	github.com/goccy/go-yaml v1.12.0
 	github.com/gophercloud/gophercloud v1.14.0
 	github.com/minio/minio-go/v7 v7.0.76
 	github.com/spf13/cobra v1.8.1
+	github.com/spf13/pflag v1.0.5
 )
 
 require (
 	github.com/SovereignCloudStack/cluster-stack-operator v0.1.0-alpha.5 // indirect
-	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/fatih/color v1.13.0 // indirect
 	github.com/go-ini/ini v1.67.0 // indirect
 	github.com/goccy/go-json v0.10.3 // indirect
@@ -25,7 +26,6 @@ require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/minio/md5-simd v1.1.2 // indirect
 	github.com/rs/xid v1.6.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/crypto v0.26.0 // indirect
 	golang.org/x/mod v0.17.0 // indirect
 	golang.org/x/net v0.28.0 // indirect
@@ -0,0 +1,173 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/SovereignCloudStack/csctl-plugin-openstack/pkg/nodeimages"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// cacheOptions contains the options of the node image cache shared by several commands.
+type cacheOptions struct {
+	dir       string
+	sizeLimit string
+	verify    bool
+}
+
+var (
+	cacheOpts = &cacheOptions{}
+	pruneAll  bool
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the local node image cache",
+	Long: `Manage the local cache of downloaded and built node images.
+
+Images are stored by their sha256 checksum and referenced by the URLs they were downloaded from or uploaded to.`,
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List the cached node images",
+	Args:         cobra.NoArgs,
+	RunE:         runCacheList,
+	SilenceUsage: true,
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove the least recently used node images from the cache",
+	Long: `Remove the least recently used node images until the cache is not larger than --cache-size-limit.
+A limit of 0 means that the cache is unlimited, so nothing is removed. With --all, all node images are removed.`,
+	Args:         cobra.NoArgs,
+	RunE:         runCachePrune,
+	SilenceUsage: true,
+}
+
+func init() {
+	cacheOpts.addFlags(cacheCmd.PersistentFlags())
+	cachePruneCmd.Flags().BoolVar(&pruneAll, "all", false, "remove all node images from the cache")
+
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+}
+
+// addFlags adds the cache flags to the flag set.
+func (o *cacheOptions) addFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&o.dir, "cache-dir", "", "directory of the node image cache (default is csctl-openstack in the user cache directory)")
+	flags.StringVar(&o.sizeLimit, "cache-size-limit", humanize.IBytes(nodeimages.DefaultCacheSizeLimit), "maximum size of the node image cache, e.g. 20GiB, or 0 for no limit")
+}
+
+// cache returns the node image cache defined by the options.
+func (o *cacheOptions) cache() (*nodeimages.Cache, error) {
+	dir := o.dir
+	if dir == "" {
+		defaultDir, err := nodeimages.DefaultCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = defaultDir
+	}
+
+	sizeLimit, err := o.sizeLimitBytes()
+	if err != nil {
+		return nil, err
+	}
+	cache := nodeimages.NewCache(dir, sizeLimit)
+	cache.SetVerify(o.verify)
+	return cache, nil
+}
+
+// sizeLimitBytes returns the size limit of the cache in bytes.
+func (o *cacheOptions) sizeLimitBytes() (int64, error) {
+	sizeLimit, err := humanize.ParseBytes(o.sizeLimit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --cache-size-limit %q: %w", o.sizeLimit, err)
+	}
+	return int64(sizeLimit), nil
+}
+
+func runCacheList(cmd *cobra.Command, _ []string) error {
+	cache, err := cacheOpts.cache()
+	if err != nil {
+		return err
+	}
+	entries, err := cache.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "SHA256\tSIZE\tLAST USED\tKEYS")
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			shortDigest(entry), humanize.IBytes(uint64(entry.Size)), entry.LastUsed.Format(time.RFC3339), strings.Join(entry.Keys, ", "))
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error writing cache list: %w", err)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "\n%d image(s), %s in %s\n", len(entries), humanize.IBytes(uint64(size)), cache.Dir())
+	return nil
+}
+
+func runCachePrune(cmd *cobra.Command, _ []string) error {
+	cache, err := cacheOpts.cache()
+	if err != nil {
+		return err
+	}
+
+	var removed []nodeimages.CacheEntry
+	if pruneAll {
+		removed, err = cache.PruneAll()
+	} else {
+		sizeLimit, sizeErr := cacheOpts.sizeLimitBytes()
+		if sizeErr != nil {
+			return sizeErr
+		}
+		if sizeLimit == 0 {
+			fmt.Fprintln(cmd.OutOrStdout(), "cache size is unlimited, use --all to remove all node images")
+			return nil
+		}
+		removed, err = cache.Prune(sizeLimit)
+	}
+	var size int64
+	for _, entry := range removed {
+		size += entry.Size
+		fmt.Fprintf(cmd.OutOrStdout(), "removed %s (%s)\n", shortDigest(entry), humanize.IBytes(uint64(entry.Size)))
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "freed %s\n", humanize.IBytes(uint64(size)))
+	return err
+}
+
+// shortDigest returns the abbreviated sha256 checksum of the cached image.
+func shortDigest(entry nodeimages.CacheEntry) string {
+	const shortDigestLength = 12
+	if entry.Checksum == nil {
+		return "-"
+	}
+	if len(entry.Checksum.SHA256) > shortDigestLength {
+		return entry.Checksum.SHA256[:shortDigestLength]
+	}
+	return entry.Checksum.SHA256
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// executeCreateNodeImages runs the create-node-images command with the arguments without running the orchestrator
+// and returns the completed options.
+func executeCreateNodeImages(t *testing.T, args []string) (createNodeImagesOptions, error) {
+	t.Helper()
+	createNodeImagesCmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err := flag.Value.Set(flag.DefValue); err != nil {
+			t.Fatalf("error resetting flag %s: %v", flag.Name, err)
+		}
+		flag.Changed = false
+	})
+	runE := createNodeImagesCmd.RunE
+	createNodeImagesCmd.RunE = func(*cobra.Command, []string) error { return nil }
+	t.Cleanup(func() { createNodeImagesCmd.RunE = runE })
+
+	rootCmd.SetArgs(append([]string{"create-node-images"}, args...))
+	rootCmd.SetOut(&bytes.Buffer{})
+	rootCmd.SetErr(&bytes.Buffer{})
+	err := rootCmd.Execute()
+	return *createNodeImagesOpts, err
+}
+
+func TestCreateNodeImagesArgs(t *testing.T) {
+	tests := []struct {
+		name                   string
+		args                   []string
+		wantClusterStackPath   string
+		wantReleaseDir         string
+		wantRegistryConfigPath string
+		wantErr                string
+	}{
+		{
+			name:                   "csctl arguments",
+			args:                   []string{"./ferrol", "./releases/ferrol", "./registry.yaml"},
+			wantClusterStackPath:   "./ferrol",
+			wantReleaseDir:         "./releases/ferrol",
+			wantRegistryConfigPath: "./registry.yaml",
+		},
+		{
+			name:                 "csctl arguments without registry",
+			args:                 []string{"./ferrol", "./releases/ferrol", ""},
+			wantClusterStackPath: "./ferrol",
+			wantReleaseDir:       "./releases/ferrol",
+		},
+		{
+			name:                 "two arguments",
+			args:                 []string{"./ferrol", "./releases/ferrol"},
+			wantClusterStackPath: "./ferrol",
+			wantReleaseDir:       "./releases/ferrol",
+		},
+		{
+			name:                   "flags",
+			args:                   []string{"--cluster-stack-path", "./ferrol", "--release-dir", "./releases/ferrol", "--node-image-registry", "./registry.yaml"},
+			wantClusterStackPath:   "./ferrol",
+			wantReleaseDir:         "./releases/ferrol",
+			wantRegistryConfigPath: "./registry.yaml",
+		},
+		{
+			name:                   "registry flag with empty argument",
+			args:                   []string{"./ferrol", "./releases/ferrol", "", "--node-image-registry", "./registry.yaml"},
+			wantClusterStackPath:   "./ferrol",
+			wantReleaseDir:         "./releases/ferrol",
+			wantRegistryConfigPath: "./registry.yaml",
+		},
+		{
+			name:                   "same flag and argument",
+			args:                   []string{"./ferrol", "./releases/ferrol", "./registry.yaml", "--release-dir", "./releases/ferrol"},
+			wantClusterStackPath:   "./ferrol",
+			wantReleaseDir:         "./releases/ferrol",
+			wantRegistryConfigPath: "./registry.yaml",
+		},
+		{
+			name:    "flag and argument differ",
+			args:    []string{"./ferrol", "./releases/ferrol", "./registry.yaml", "--node-image-registry", "./other.yaml"},
+			wantErr: "node-image-registry is set both as argument and flag",
+		},
+		{
+			name:    "too many arguments",
+			args:    []string{"./ferrol", "./releases/ferrol", "./registry.yaml", "extra"},
+			wantErr: "accepts at most 3 arg(s), received 4",
+		},
+		{
+			name:    "missing release directory",
+			args:    []string{"./ferrol"},
+			wantErr: "release directory must be set",
+		},
+		{
+			name:    "empty release directory",
+			args:    []string{"./ferrol", "", ""},
+			wantErr: "release directory must be set",
+		},
+		{
+			name:    "missing cluster stack path",
+			wantErr: "cluster stack path must be set",
+		},
+		{
+			name:    "invalid parallel",
+			args:    []string{"./ferrol", "./releases/ferrol", "", "--parallel", "0"},
+			wantErr: "--parallel must be at least 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := executeCreateNodeImages(t, tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if opts.clusterStackPath != tt.wantClusterStackPath {
+				t.Errorf("cluster stack path is %q, want %q", opts.clusterStackPath, tt.wantClusterStackPath)
+			}
+			if opts.releaseDir != tt.wantReleaseDir {
+				t.Errorf("release directory is %q, want %q", opts.releaseDir, tt.wantReleaseDir)
+			}
+			if opts.registryConfigPath != tt.wantRegistryConfigPath {
+				t.Errorf("registry config path is %q, want %q", opts.registryConfigPath, tt.wantRegistryConfigPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SovereignCloudStack/csctl-plugin-openstack/pkg/nodeimages"
+)
+
+// Exit codes of the create-node-images command. Every other error exits with code 1.
+const (
+	exitCodeConfigInvalid   = 2
+	exitCodeWrongProvider   = 3
+	exitCodeBuildFailed     = 4
+	exitCodeUploadFailed    = 5
+	exitCodeURLUpdateFailed = 6
+	exitCodeURLVerification = 7
+	exitCodeLocked          = 8
+	// exitCodeInterrupted is the conventional exit code of a process stopped by SIGINT (128 + 2).
+	exitCodeInterrupted = 130
+)
+
+// exitError is an error that causes the process to exit with the given code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode maps the errors of node image operations to distinct exit codes.
+func withExitCode(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	code := 1
+	switch {
+	case errors.Is(err, context.Canceled):
+		// an interrupted operation fails with the error of the step that was canceled
+		code = exitCodeInterrupted
+	case errors.Is(err, nodeimages.ErrConfigInvalid):
+		code = exitCodeConfigInvalid
+	case errors.Is(err, nodeimages.ErrWrongProvider):
+		code = exitCodeWrongProvider
+	case errors.Is(err, nodeimages.ErrBuildFailed):
+		code = exitCodeBuildFailed
+	case errors.Is(err, nodeimages.ErrUploadFailed):
+		code = exitCodeUploadFailed
+	case errors.Is(err, nodeimages.ErrURLUpdateFailed):
+		code = exitCodeURLUpdateFailed
+	case errors.Is(err, nodeimages.ErrURLVerificationFailed):
+		code = exitCodeURLVerification
+	case errors.Is(err, nodeimages.ErrLocked):
+		code = exitCodeLocked
+	}
+	return &exitError{code: code, err: err}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/SovereignCloudStack/csctl-plugin-openstack/pkg/nodeimages"
+)
+
+func TestWithExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+	}{
+		{name: "config invalid", err: fmt.Errorf("%w: field 'name' must be defined", nodeimages.ErrConfigInvalid), wantCode: exitCodeConfigInvalid},
+		{name: "wrong provider", err: fmt.Errorf("error: %w", nodeimages.ErrWrongProvider), wantCode: exitCodeWrongProvider},
+		{name: "build failed", err: fmt.Errorf("image ubuntu: %w", fmt.Errorf("%w: packer exited", nodeimages.ErrBuildFailed)), wantCode: exitCodeBuildFailed},
+		{name: "upload failed", err: fmt.Errorf("%w: error pushing image: %w", nodeimages.ErrUploadFailed, errors.New("connection reset")), wantCode: exitCodeUploadFailed},
+		{name: "URL update failed", err: fmt.Errorf("%w: error updating URL", nodeimages.ErrURLUpdateFailed), wantCode: exitCodeURLUpdateFailed},
+		{name: "URL verification failed", err: fmt.Errorf("%w: 404 Not Found", nodeimages.ErrURLVerificationFailed), wantCode: exitCodeURLVerification},
+		{name: "locked", err: fmt.Errorf("error: %w", nodeimages.ErrLocked), wantCode: exitCodeLocked},
+		{name: "interrupted", err: fmt.Errorf("%w: error uploading image: %w", nodeimages.ErrUploadFailed, context.Canceled), wantCode: exitCodeInterrupted},
+		{name: "first of joined errors", err: errors.Join(fmt.Errorf("%w: ubuntu", nodeimages.ErrBuildFailed), fmt.Errorf("%w: debian", nodeimages.ErrUploadFailed)), wantCode: exitCodeBuildFailed},
+		{name: "other error", err: errors.New("unexpected"), wantCode: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := withExitCode(tt.err)
+			var exitErr *exitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("expected exitError, got %v", err)
+			}
+			if exitErr.code != tt.wantCode {
+				t.Errorf("exit code is %d, want %d", exitErr.code, tt.wantCode)
+			}
+			if !errors.Is(err, tt.err) || err.Error() != tt.err.Error() {
+				t.Errorf("error is %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	if err := withExitCode(nil); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SovereignCloudStack/csctl-plugin-openstack/pkg/nodeimages"
+	"github.com/spf13/cobra"
+)
+
+var importTimeout time.Duration
+
+var importNodeImagesCmd = &cobra.Command{
+	Use:   "import-node-images node-images-file [node-image-registry-path]",
+	Short: "Import node images into Glance from their URLs",
+	Long: `Import every node image defined in a node-images.yaml or config.yaml file into Glance
+using the web-download method of the Glance interoperable image import.
+
+Images with the same name which already exist in Glance are skipped.
+Templates are not rendered, so import the node-images.yaml file generated by create-node-images
+instead of a config.yaml file with templates.
+If the node image registry path is not given, the standard OS_* environment variables are used for authentication.`,
+	Args:         cobra.RangeArgs(1, 2),
+	RunE:         runImportNodeImages,
+	SilenceUsage: true,
+}
+
+func init() {
+	importNodeImagesCmd.Flags().DurationVar(&importTimeout, "timeout", time.Hour, "maximum time to wait for all images to be imported")
+}
+
+func runImportNodeImages(cmd *cobra.Command, args []string) error {
+	return withExitCode(importNodeImages(cmd, args))
+}
+
+// importNodeImages imports the node images and marks its errors like create-node-images, so they are mapped to the
+// same exit codes.
+func importNodeImages(cmd *cobra.Command, args []string) error {
+	out := cmd.OutOrStdout()
+	nodeImages, err := nodeimages.GetConfig(args[0])
+	if err != nil {
+		return fmt.Errorf("%w: %w", nodeimages.ErrConfigInvalid, err)
+	}
+	// Only create-node-images knows the cluster stack release the templates are rendered for
+	if err := nodeimages.CheckRendered(nodeImages); err != nil {
+		return fmt.Errorf("%w: %s contains templates, import the node-images.yaml generated by create-node-images instead: %w",
+			nodeimages.ErrConfigInvalid, args[0], err)
+	}
+
+	registryConfig := &nodeimages.RegistryConfig{Type: nodeimages.RegistryTypeGlance}
+	if len(args) == 2 {
+		registryConfig, err = nodeimages.GetRegistryConfig(args[1])
+		if err != nil {
+			return fmt.Errorf("%w: %w", nodeimages.ErrConfigInvalid, err)
+		}
+		if registryConfig.Type != nodeimages.RegistryTypeGlance {
+			return fmt.Errorf("%w: wrong registry type in %s. Expected %s", nodeimages.ErrConfigInvalid, args[1], nodeimages.RegistryTypeGlance)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), importTimeout)
+	defer cancel()
+
+	registry, err := nodeimages.NewRegistry(ctx, registryConfig)
+	if err != nil {
+		return fmt.Errorf("%w: error initializing Glance client: %w", nodeimages.ErrUploadFailed, err)
+	}
+	importer, ok := registry.(nodeimages.ImageImporter)
+	if !ok {
+		return fmt.Errorf("%w: registry type %s does not support image import", nodeimages.ErrConfigInvalid, registryConfig.Type)
+	}
+
+	for _, image := range nodeImages.OpenStackNodeImages {
+		if image.URL == "" {
+			return fmt.Errorf("%w: field 'url' of image %s must be defined", nodeimages.ErrConfigInvalid, image.CreateOpts.Name)
+		}
+
+		info, err := registry.Stat(ctx, image.CreateOpts.Name)
+		if err != nil && !errors.Is(err, nodeimages.ErrObjectNotFound) {
+			return fmt.Errorf("%w: %w", nodeimages.ErrUploadFailed, err)
+		}
+		if info != nil {
+			fmt.Fprintf(out, "Image %s already exists, skipping import\n", image.CreateOpts.Name)
+			continue
+		}
+
+		fmt.Fprintf(out, "Importing image %s from %s...\n", image.CreateOpts.Name, image.URL)
+		imageID, err := importer.ImportImage(ctx, image.CreateOpts, image.URL)
+		if err != nil {
+			return fmt.Errorf("%w: %w", nodeimages.ErrUploadFailed, err)
+		}
+		fmt.Fprintf(out, "Image %s imported successfully with ID %s\n", image.CreateOpts.Name, imageID)
+	}
+	return nil
+}
@@ -15,8 +15,15 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
+	"github.com/SovereignCloudStack/csctl-plugin-openstack/pkg/nodeimages"
 	"github.com/spf13/cobra"
 )
 
@@ -31,13 +38,59 @@ var rootCmd = &cobra.Command{
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := notifyContext(context.Background())
+	err := rootCmd.ExecuteContext(ctx)
+	interrupted := ctx.Err() != nil
+	stop()
 	if err != nil {
+		if interrupted {
+			os.Exit(exitCodeInterrupted)
+		}
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
 		os.Exit(1)
 	}
 }
 
+// notifyContext returns a context which is canceled on the first SIGINT or SIGTERM, so running builds and uploads
+// can stop and clean up. A second signal kills the running packer builds and terminates the process immediately.
+func notifyContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "Received %s, cleaning up. Press Ctrl-C again to exit immediately.\n", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		// packer runs in its own process group, which does not receive the signals of the terminal
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "Received %s again, exiting.\n", sig)
+			nodeimages.KillPackerBuilds()
+			os.Exit(exitCodeInterrupted)
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() { close(done) })
+		cancel()
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(createNodeImagesCmd)
+	rootCmd.AddCommand(importNodeImagesCmd)
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(cacheCmd)
 	rootCmd.AddCommand(versionCmd)
 }
@@ -0,0 +1,53 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/SovereignCloudStack/csctl-plugin-openstack/pkg/nodeimages"
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate cluster-stack-directory [node-image-registry-path]",
+	Short: "Validate the configuration files of a cluster stack",
+	Long: `Validate csctl.yaml, node-images/config.yaml and the node image registry config of a cluster stack
+without building or uploading anything.
+
+All problems are reported at once together with their position in the file.
+The node image registry config is required if the build or mirror method is used.`,
+	Example:      `  csctl-openstack validate ./ferrol ./registry.yaml`,
+	Args:         cobra.RangeArgs(1, 2),
+	RunE:         runValidate,
+	SilenceUsage: true,
+}
+
+func runValidate(cmd *cobra.Command, args []string) error {
+	var registryConfigPath string
+	if len(args) == 2 {
+		registryConfigPath = args[1]
+	}
+
+	warnings, err := nodeimages.Validate(args[0], registryConfigPath)
+	for _, warning := range warnings {
+		fmt.Fprintf(cmd.ErrOrStderr(), "Warning: %s\n", warning)
+	}
+	if err != nil {
+		return withExitCode(err)
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "cluster stack %s is valid\n", args[0])
+	return nil
+}
@@ -0,0 +1,552 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultCacheSizeLimit is the default maximum size of the node image cache in bytes.
+	DefaultCacheSizeLimit = 50 * GiB
+
+	cacheBlobsDir = "blobs"
+	cacheRefsDir  = "refs"
+)
+
+// sha256Regex matches a hex encoded sha256 checksum.
+var sha256Regex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Cache is a content-addressed local cache of node images. Images are stored by their sha256 checksum
+// and can be looked up by their checksum or by a key, usually the URL they were downloaded from or uploaded to.
+//
+// The cache is laid out as follows:
+//
+//	<dir>/blobs/<sha256>       image content
+//	<dir>/blobs/<sha256>.json  checksums, file info and last use of the image
+//	<dir>/refs/<sha256(key)>   reference from a key to an image
+type Cache struct {
+	dir       string
+	sizeLimit int64
+	verify    bool
+}
+
+// CacheEntry describes an image in the cache.
+type CacheEntry struct {
+	// Path is the path to the cached image.
+	Path string
+	// Checksum contains the checksums of the cached image.
+	Checksum *Checksum
+	// Size is the size of the cached image in bytes.
+	Size int64
+	// LastUsed is the time the cached image was last used.
+	LastUsed time.Time
+	// Keys are the keys referencing the cached image.
+	Keys []string
+}
+
+// cacheBlob is the content of the checksum file of a cached image. Size and ModTime are the file info of the image
+// when its checksums were computed, so an unchanged image does not have to be hashed again every time it is used.
+type cacheBlob struct {
+	Checksum
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// cacheRef is the content of a reference file.
+type cacheRef struct {
+	Key    string `json:"key"`
+	SHA256 string `json:"sha256"`
+	// ETag and LastModified are the validators of the response the image was downloaded with,
+	// so the cached image can be revalidated against its URL.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// DefaultCacheDir returns the default directory of the node image cache in the user cache directory,
+// e.g. $XDG_CACHE_HOME/csctl-openstack on Linux.
+func DefaultCacheDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting user cache directory: %w", err)
+	}
+	return filepath.Join(cacheDir, "csctl-openstack"), nil
+}
+
+// NewCache returns a cache in the given directory. If sizeLimit is greater than zero,
+// the least recently used images are removed when the cache grows larger than sizeLimit bytes.
+func NewCache(dir string, sizeLimit int64) *Cache {
+	return &Cache{dir: dir, sizeLimit: sizeLimit}
+}
+
+// SetVerify sets whether the checksums of a cached image are computed every time it is used. By default, they are
+// only computed again if the size or the modification time of the image changed since it was cached.
+func (c *Cache) SetVerify(verify bool) {
+	c.verify = verify
+}
+
+// Dir returns the directory of the cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+func (c *Cache) blobPath(digest string) string {
+	return filepath.Join(c.dir, cacheBlobsDir, digest)
+}
+
+func (c *Cache) refPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, cacheRefsDir, hex.EncodeToString(sum[:]))
+}
+
+// Lookup returns the path and the checksums of the cached image with the given checksum or, if checksum is nil
+// or has no sha256 checksum, of the cached image referenced by key. If the size or the modification time of the
+// cached image changed since it was cached, or if verification is enabled with SetVerify, the checksums are computed
+// from the cached image, so an image which was modified after it was cached is removed from the cache instead of
+// being returned.
+func (c *Cache) Lookup(key string, checksum *Checksum) (string, *Checksum, bool) {
+	var digest string
+	if checksum != nil && sha256Regex.MatchString(strings.ToLower(checksum.SHA256)) {
+		digest = strings.ToLower(checksum.SHA256)
+	} else {
+		ref, err := c.readRef(c.refPath(key))
+		if err != nil {
+			return "", nil, false
+		}
+		digest = ref.SHA256
+	}
+	if !sha256Regex.MatchString(digest) {
+		return "", nil, false
+	}
+
+	blobPath := c.blobPath(digest)
+	fileInfo, err := os.Stat(blobPath)
+	if err != nil {
+		return "", nil, false
+	}
+	blob, err := c.readBlob(digest)
+	if c.verify || err != nil || blob.SHA256 != digest || blob.Size != fileInfo.Size() || !blob.ModTime.Equal(fileInfo.ModTime()) {
+		checksum, ok := c.verifyBlob(digest)
+		if !ok {
+			return "", nil, false
+		}
+		blob = &cacheBlob{Checksum: *checksum, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}
+	}
+
+	// mark the image as recently used
+	blob.LastUsed = time.Now()
+	if err := c.writeBlob(digest, blob); err != nil {
+		return "", nil, false
+	}
+
+	if key != "" {
+		if err := c.writeRef(key, digest); err != nil {
+			return "", nil, false
+		}
+	}
+	blobChecksum := blob.Checksum
+	return blobPath, &blobChecksum, true
+}
+
+// Download returns the path and the checksums of the image at url from the cache, and downloads it first if it
+// is not cached. If checksum is set, the downloaded image is verified against it and an image with the same checksum
+// is taken from the cache without a request. Otherwise, the image at url may have changed since it was cached, so the
+// cached image is revalidated with a conditional request and only used if the server reports it as not modified.
+func (c *Cache) Download(ctx context.Context, client *http.Client, url string, checksum *Checksum) (string, *Checksum, error) {
+	if checksum != nil && sha256Regex.MatchString(strings.ToLower(checksum.SHA256)) {
+		if blobPath, blobChecksum, ok := c.Lookup(url, checksum); ok {
+			if err := compareChecksums(url, checksum, blobChecksum); err != nil {
+				return "", nil, err
+			}
+			return blobPath, blobChecksum, nil
+		}
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ref, err := c.readRef(c.refPath(url))
+	if err != nil || (ref.ETag == "" && ref.LastModified == "") {
+		ref = nil
+	}
+	resp, err := get(ctx, client, url, ref)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		if blobPath, blobChecksum, ok := c.Lookup(url, &Checksum{SHA256: ref.SHA256}); ok {
+			if err := compareChecksums(url, checksum, blobChecksum); err != nil {
+				return "", nil, err
+			}
+			return blobPath, blobChecksum, nil
+		}
+		// the cached image was removed in the meantime
+		resp, err = get(ctx, client, url, nil)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("%w: %s: %s", errURLUnreachable, url, resp.Status)
+	}
+
+	blobPath, blobChecksum, err := c.store(url, func(file io.Writer) error {
+		if _, err := io.Copy(file, resp.Body); err != nil {
+			return fmt.Errorf("error downloading %s: %w", url, err)
+		}
+		return nil
+	}, checksum)
+	if err != nil {
+		return "", nil, err
+	}
+	err = c.saveRef(&cacheRef{
+		Key:          url,
+		SHA256:       blobChecksum.SHA256,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return blobPath, blobChecksum, nil
+}
+
+// get requests the image at url. If ref is set, the request is conditional on the validators of ref,
+// so the server responds with 304 Not Modified if the image did not change.
+func get(ctx context.Context, client *http.Client, url string, ref *cacheRef) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for %s: %w", url, err)
+	}
+	if ref != nil {
+		if ref.ETag != "" {
+			req.Header.Set("If-None-Match", ref.ETag)
+		}
+		if ref.LastModified != "" {
+			req.Header.Set("If-Modified-Since", ref.LastModified)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errURLUnreachable, err)
+	}
+	return resp, nil
+}
+
+// Add copies the file into the cache and references it by key. The file is copied instead of linked, so the cached
+// image is not changed when the file is overwritten later, e.g. by the next build. If checksum is set, the file is
+// verified against it and is not copied again if an image with the same checksum is already cached.
+func (c *Cache) Add(key, filePath string, checksum *Checksum) (string, *Checksum, error) {
+	if checksum != nil && sha256Regex.MatchString(strings.ToLower(checksum.SHA256)) {
+		if blobPath, blobChecksum, ok := c.Lookup(key, checksum); ok {
+			return blobPath, blobChecksum, nil
+		}
+	}
+
+	return c.store(key, func(file io.Writer) error {
+		// #nosec G304
+		src, err := os.Open(filePath)
+		if err != nil {
+			return fmt.Errorf("error opening file: %w", err)
+		}
+		defer src.Close()
+		if _, err := io.Copy(file, src); err != nil {
+			return fmt.Errorf("error copying %s into cache: %w", filePath, err)
+		}
+		return nil
+	}, checksum)
+}
+
+// store writes an image with write into a temporary file, verifies it against expected, if set,
+// and moves it to its content-addressed location. The checksums are computed while writing.
+func (c *Cache) store(key string, write func(file io.Writer) error, expected *Checksum) (string, *Checksum, error) {
+	blobsDir := filepath.Join(c.dir, cacheBlobsDir)
+	if err := os.MkdirAll(blobsDir, os.FileMode(0o755)); err != nil {
+		return "", nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(blobsDir, ".download.*")
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hashes := newChecksumWriter()
+	if err := write(io.MultiWriter(tmpFile, hashes)); err != nil {
+		return "", nil, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", nil, fmt.Errorf("error writing cache file: %w", err)
+	}
+
+	checksum := hashes.checksum()
+	if err := compareChecksums(key, expected, checksum); err != nil {
+		return "", nil, err
+	}
+
+	blobPath := c.blobPath(checksum.SHA256)
+	if err := os.Rename(tmpFile.Name(), blobPath); err != nil {
+		return "", nil, fmt.Errorf("error moving file into cache: %w", err)
+	}
+	if err := c.commit(key, checksum); err != nil {
+		return "", nil, err
+	}
+	return blobPath, checksum, nil
+}
+
+// commit records the checksums and the reference of a new image and enforces the size limit.
+func (c *Cache) commit(key string, checksum *Checksum) error {
+	fileInfo, err := os.Stat(c.blobPath(checksum.SHA256))
+	if err != nil {
+		return fmt.Errorf("error getting file info of cached image: %w", err)
+	}
+	blob := &cacheBlob{Checksum: *checksum, Size: fileInfo.Size(), ModTime: fileInfo.ModTime(), LastUsed: time.Now()}
+	if err := c.writeBlob(checksum.SHA256, blob); err != nil {
+		return err
+	}
+	if key != "" {
+		if err := c.writeRef(key, checksum.SHA256); err != nil {
+			return err
+		}
+	}
+
+	if c.sizeLimit > 0 {
+		if _, err := c.prune(c.sizeLimit, checksum.SHA256); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyBlob computes the checksums of the cached image with the given digest. If the image does not match its
+// digest, it is removed from the cache.
+func (c *Cache) verifyBlob(digest string) (*Checksum, bool) {
+	blobPath := c.blobPath(digest)
+	checksum, err := FileChecksum(blobPath)
+	if err != nil {
+		return nil, false
+	}
+	if checksum.SHA256 != digest {
+		_ = os.Remove(blobPath + ".json")
+		_ = os.Remove(blobPath)
+		return nil, false
+	}
+	return checksum, true
+}
+
+func (c *Cache) readBlob(digest string) (*cacheBlob, error) {
+	// #nosec G304
+	data, err := os.ReadFile(c.blobPath(digest) + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("error reading checksum from cache: %w", err)
+	}
+	var blob cacheBlob
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return nil, fmt.Errorf("error unmarshaling checksum: %w", err)
+	}
+	return &blob, nil
+}
+
+func (c *Cache) writeBlob(digest string, blob *cacheBlob) error {
+	data, err := json.Marshal(blob)
+	if err != nil {
+		return fmt.Errorf("error marshaling checksum: %w", err)
+	}
+	if err := os.WriteFile(c.blobPath(digest)+".json", data, os.FileMode(0o644)); err != nil {
+		return fmt.Errorf("error writing checksum into cache: %w", err)
+	}
+	return nil
+}
+
+func (c *Cache) readRef(refPath string) (*cacheRef, error) {
+	// #nosec G304
+	data, err := os.ReadFile(refPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cache reference: %w", err)
+	}
+	var ref cacheRef
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return nil, fmt.Errorf("error unmarshaling cache reference: %w", err)
+	}
+	return &ref, nil
+}
+
+// writeRef references the image with the given digest by key. The validators of an existing reference to the same
+// image are kept.
+func (c *Cache) writeRef(key, digest string) error {
+	ref := &cacheRef{Key: key, SHA256: digest}
+	if existing, err := c.readRef(c.refPath(key)); err == nil && existing.SHA256 == digest {
+		ref.ETag, ref.LastModified = existing.ETag, existing.LastModified
+	}
+	return c.saveRef(ref)
+}
+
+func (c *Cache) saveRef(ref *cacheRef) error {
+	if err := os.MkdirAll(filepath.Join(c.dir, cacheRefsDir), os.FileMode(0o755)); err != nil {
+		return fmt.Errorf("error creating cache directory: %w", err)
+	}
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return fmt.Errorf("error marshaling cache reference: %w", err)
+	}
+	if err := os.WriteFile(c.refPath(ref.Key), data, os.FileMode(0o644)); err != nil {
+		return fmt.Errorf("error writing cache reference: %w", err)
+	}
+	return nil
+}
+
+// List returns all cached images, the most recently used first.
+func (c *Cache) List() ([]CacheEntry, error) {
+	keys := make(map[string][]string)
+	refEntries, err := os.ReadDir(filepath.Join(c.dir, cacheRefsDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error reading cache directory: %w", err)
+	}
+	for _, refEntry := range refEntries {
+		ref, err := c.readRef(filepath.Join(c.dir, cacheRefsDir, refEntry.Name()))
+		if err != nil {
+			continue
+		}
+		keys[ref.SHA256] = append(keys[ref.SHA256], ref.Key)
+	}
+
+	blobEntries, err := os.ReadDir(filepath.Join(c.dir, cacheBlobsDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error reading cache directory: %w", err)
+	}
+	entries := make([]CacheEntry, 0, len(blobEntries))
+	for _, blobEntry := range blobEntries {
+		digest := blobEntry.Name()
+		if !sha256Regex.MatchString(digest) {
+			continue
+		}
+		fileInfo, err := blobEntry.Info()
+		if err != nil {
+			continue
+		}
+		// A missing or corrupted checksum file must not hide the image from pruning
+		blob, err := c.readBlob(digest)
+		if err != nil || blob.SHA256 != digest {
+			blob = &cacheBlob{Checksum: Checksum{SHA256: digest}}
+		}
+		lastUsed := blob.LastUsed
+		if lastUsed.IsZero() {
+			lastUsed = fileInfo.ModTime()
+		}
+		sort.Strings(keys[digest])
+		checksum := blob.Checksum
+		entries = append(entries, CacheEntry{
+			Path:     c.blobPath(digest),
+			Checksum: &checksum,
+			Size:     fileInfo.Size(),
+			LastUsed: lastUsed,
+			Keys:     keys[digest],
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Prune removes the least recently used images until the cache is not larger than sizeLimit bytes
+// and returns the removed images. Like in NewCache, a sizeLimit of zero means that the cache is unlimited,
+// so nothing is removed.
+func (c *Cache) Prune(sizeLimit int64) ([]CacheEntry, error) {
+	if sizeLimit <= 0 {
+		return nil, nil
+	}
+	return c.prune(sizeLimit, "")
+}
+
+// PruneAll removes all images from the cache and returns the removed images.
+func (c *Cache) PruneAll() ([]CacheEntry, error) {
+	return c.prune(-1, "")
+}
+
+// prune removes the least recently used images except the one with the digest keep.
+func (c *Cache) prune(sizeLimit int64, keep string) ([]CacheEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+
+	var removed []CacheEntry
+	for i := len(entries) - 1; i >= 0 && size > sizeLimit; i-- {
+		entry := entries[i]
+		if entry.Checksum.SHA256 == keep {
+			continue
+		}
+		if err := c.remove(entry); err != nil {
+			return removed, err
+		}
+		size -= entry.Size
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+// remove removes the image and all references to it from the cache.
+func (c *Cache) remove(entry CacheEntry) error {
+	for _, key := range entry.Keys {
+		if err := os.Remove(c.refPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("error removing cache reference: %w", err)
+		}
+	}
+	if err := os.Remove(entry.Path + ".json"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error removing checksum from cache: %w", err)
+	}
+	if err := os.Remove(entry.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error removing image from cache: %w", err)
+	}
+	return nil
+}
+
+// compareChecksums returns an error if the checksums defined in expected do not match actual.
+func compareChecksums(name string, expected, actual *Checksum) error {
+	if expected == nil {
+		return nil
+	}
+	if expected.SHA256 != "" && !strings.EqualFold(expected.SHA256, actual.SHA256) {
+		return fmt.Errorf("%w: %s: expected sha256 %s, got %s", errChecksumMismatch, name, expected.SHA256, actual.SHA256)
+	}
+	if expected.OSHashAlgo == HashAlgoSHA512 && expected.OSHashValue != "" && !strings.EqualFold(expected.OSHashValue, actual.OSHashValue) {
+		return fmt.Errorf("%w: %s: expected %s %s, got %s", errChecksumMismatch, name, HashAlgoSHA512, expected.OSHashValue, actual.OSHashValue)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheAddWithChecksum(t *testing.T) {
+	cache := NewCache(t.TempDir(), 0)
+	imagePath := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(imagePath, []byte(testImageContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := testImageChecksum(t)
+	blobPath, blobChecksum, err := cache.Add("https://example.com/image", imagePath, checksum)
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if *blobChecksum != *checksum {
+		t.Errorf("checksum is %+v, want %+v", blobChecksum, checksum)
+	}
+	if data, err := os.ReadFile(blobPath); err != nil || string(data) != testImageContent {
+		t.Errorf("cached image is %q (%v), want %q", data, err, testImageContent)
+	}
+
+	if _, lookupChecksum, ok := cache.Lookup("https://example.com/image", nil); !ok || *lookupChecksum != *checksum {
+		t.Errorf("lookup returned %+v, %t", lookupChecksum, ok)
+	}
+}
+
+func TestCacheListCorruptedChecksum(t *testing.T) {
+	cache := NewCache(t.TempDir(), 0)
+	imagePath := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(imagePath, []byte(testImageContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	blobPath, checksum, err := cache.Add("https://example.com/image", imagePath, nil)
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if err := os.WriteFile(blobPath+".json", []byte(`{"sha256": "abc"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := cache.List()
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Checksum.SHA256 != checksum.SHA256 {
+		t.Fatalf("listed %+v, want the image with the corrupted checksum file", entries)
+	}
+
+	removed, err := cache.PruneAll()
+	if err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+	if len(removed) != 1 {
+		t.Errorf("removed %d images, want 1", len(removed))
+	}
+	if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+		t.Errorf("image was not removed from cache: %v", err)
+	}
+}
+
+func TestCacheAddKeepsImageWhenFileIsOverwritten(t *testing.T) {
+	cache := NewCache(t.TempDir(), 0)
+	imagePath := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(imagePath, []byte(testImageContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	blobPath, checksum, err := cache.Add("https://example.com/image", imagePath, nil)
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	// the next build rewrites the image in place
+	if err := os.WriteFile(imagePath, []byte("rebuilt node image"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(blobPath); err != nil || string(data) != testImageContent {
+		t.Errorf("cached image is %q (%v), want %q", data, err, testImageContent)
+	}
+	if _, lookupChecksum, ok := cache.Lookup("https://example.com/image", nil); !ok || *lookupChecksum != *checksum {
+		t.Errorf("lookup returned %+v, %t", lookupChecksum, ok)
+	}
+}
+
+func TestCacheLookupCorruptedImage(t *testing.T) {
+	cache := NewCache(t.TempDir(), 0)
+	imagePath := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(imagePath, []byte(testImageContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	blobPath, checksum, err := cache.Add("https://example.com/image", imagePath, nil)
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if err := os.WriteFile(blobPath, []byte("corrupted node image"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		checksum *Checksum
+	}{
+		{name: "by key"},
+		{name: "by checksum", checksum: checksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if path, _, ok := cache.Lookup("https://example.com/image", tt.checksum); ok {
+				t.Fatalf("lookup returned the corrupted image %s", path)
+			}
+		})
+	}
+	if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+		t.Errorf("corrupted image was not removed from cache: %v", err)
+	}
+}
+
+func TestCacheLookupModifiedImage(t *testing.T) {
+	tests := []struct {
+		name          string
+		keepModTime   bool
+		verify        bool
+		wantCorrupted bool
+	}{
+		// an image with unchanged size and modification time is not hashed again
+		{name: "same size and modification time", keepModTime: true, wantCorrupted: true},
+		{name: "same size and modification time with verification", keepModTime: true, verify: true},
+		{name: "modification time changed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewCache(t.TempDir(), 0)
+			cache.SetVerify(tt.verify)
+			imagePath := filepath.Join(t.TempDir(), "image")
+			writeFile(t, imagePath, testImageContent, 0o600)
+			blobPath, _, err := cache.Add("https://example.com/image", imagePath, nil)
+			if err != nil {
+				t.Fatalf("add failed: %v", err)
+			}
+			fileInfo, err := os.Stat(blobPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// corrupt the image without changing its size
+			corrupted := strings.ToUpper(testImageContent)
+			if err := os.WriteFile(blobPath, []byte(corrupted), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			modTime := fileInfo.ModTime()
+			if !tt.keepModTime {
+				modTime = modTime.Add(-time.Hour)
+			}
+			if err := os.Chtimes(blobPath, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+
+			path, _, ok := cache.Lookup("https://example.com/image", nil)
+			if ok != tt.wantCorrupted {
+				t.Fatalf("lookup returned %s, %t, want %t", path, ok, tt.wantCorrupted)
+			}
+			if _, err := os.Stat(blobPath); tt.wantCorrupted != (err == nil) {
+				t.Errorf("corrupted image exists is %t, want %t", err == nil, tt.wantCorrupted)
+			}
+		})
+	}
+}
+
+func TestCacheLookupWithoutFileInfo(t *testing.T) {
+	cache := NewCache(t.TempDir(), 0)
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeFile(t, imagePath, testImageContent, 0o600)
+	blobPath, checksum, err := cache.Add("https://example.com/image", imagePath, nil)
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	// checksum file written by a previous version, which contains only the checksums
+	data, err := json.Marshal(checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blobPath+".json", data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, lookupChecksum, ok := cache.Lookup("https://example.com/image", nil); !ok || *lookupChecksum != *checksum {
+		t.Fatalf("lookup returned %+v, %t", lookupChecksum, ok)
+	}
+	blob, err := cache.readBlob(checksum.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Size != int64(len(testImageContent)) || blob.ModTime.IsZero() || blob.LastUsed.IsZero() {
+		t.Errorf("checksum file was not updated with the file info: %+v", blob)
+	}
+}
+
+func TestCacheDownloadRevalidates(t *testing.T) {
+	content := testImageContent
+	var requests, downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		etag := fmt.Sprintf("%q", fmt.Sprintf("%x", sha256.Sum256([]byte(content))))
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(content))
+	}))
+	t.Cleanup(server.Close)
+	cache := NewCache(t.TempDir(), 0)
+	url := server.URL + "/image"
+
+	tests := []struct {
+		name          string
+		content       string
+		wantDownloads int
+	}{
+		{name: "first download", content: testImageContent, wantDownloads: 1},
+		{name: "not modified", content: testImageContent, wantDownloads: 1},
+		{name: "changed upstream", content: "rebuilt node image", wantDownloads: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content = tt.content
+			blobPath, _, err := cache.Download(context.Background(), server.Client(), url, nil)
+			if err != nil {
+				t.Fatalf("download failed: %v", err)
+			}
+			if data, err := os.ReadFile(blobPath); err != nil || string(data) != tt.content {
+				t.Errorf("downloaded image is %q (%v), want %q", data, err, tt.content)
+			}
+			if downloads != tt.wantDownloads {
+				t.Errorf("image was downloaded %d times, want %d", downloads, tt.wantDownloads)
+			}
+		})
+	}
+
+	// an image with a checksum is taken from the cache without a request
+	requestsBefore := requests
+	if _, _, err := cache.Download(context.Background(), server.Client(), url, &Checksum{SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(content)))}); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if requests != requestsBefore {
+		t.Errorf("sent %d requests for an image with a cached checksum", requests-requestsBefore)
+	}
+}
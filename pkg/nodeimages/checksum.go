@@ -0,0 +1,111 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// HashAlgoSHA512 is the hash algorithm Glance uses for os_hash_algo by default.
+const HashAlgoSHA512 = "sha512"
+
+// Checksum contains the checksums of a node image file.
+type Checksum struct {
+	// SHA256 is the hex encoded sha256 checksum of the image file.
+	SHA256 string `json:"sha256" yaml:"sha256"`
+	// OSHashAlgo is the algorithm of OSHashValue, like os_hash_algo of Glance images.
+	OSHashAlgo string `json:"os_hash_algo" yaml:"os_hash_algo"` //nolint:tagliatelle // same naming as Glance
+	// OSHashValue is the hex encoded multihash of the image file, like os_hash_value of Glance images.
+	OSHashValue string `json:"os_hash_value" yaml:"os_hash_value"` //nolint:tagliatelle // same naming as Glance
+}
+
+// checksumWriter computes the checksums of the data written to it.
+type checksumWriter struct {
+	sha256 hash.Hash
+	sha512 hash.Hash
+}
+
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{sha256: sha256.New(), sha512: sha512.New()}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	// Writing to a hash never fails
+	c.sha256.Write(p)
+	c.sha512.Write(p)
+	return len(p), nil
+}
+
+// checksum returns the checksums of the data written so far.
+func (c *checksumWriter) checksum() *Checksum {
+	return &Checksum{
+		SHA256:      hex.EncodeToString(c.sha256.Sum(nil)),
+		OSHashAlgo:  HashAlgoSHA512,
+		OSHashValue: hex.EncodeToString(c.sha512.Sum(nil)),
+	}
+}
+
+// checksumReader computes the checksums of the data read through it.
+type checksumReader struct {
+	reader io.Reader
+	hashes *checksumWriter
+	n      int64
+}
+
+func newChecksumReader(reader io.Reader) *checksumReader {
+	hashes := newChecksumWriter()
+	return &checksumReader{reader: io.TeeReader(reader, hashes), hashes: hashes}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err //nolint:wrapcheck // errors of the underlying reader have to be returned unchanged
+}
+
+// checksum returns the checksums of the data read so far.
+func (c *checksumReader) checksum() *Checksum {
+	return c.hashes.checksum()
+}
+
+// FileChecksum computes the checksums of the file.
+func FileChecksum(filePath string) (*Checksum, error) {
+	file, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	reader := newChecksumReader(file)
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	return reader.checksum(), nil
+}
+
+// uploadChecksum returns the checksums computed while uploading the file. If the registry
+// did not read the file exactly once from start to end, the checksums are computed from the file.
+func uploadChecksum(reader *checksumReader, filePath string, size int64) (*Checksum, error) {
+	if reader.n == size {
+		return reader.checksum(), nil
+	}
+	return FileChecksum(filePath)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nodeimages implements loading of the node images configuration, building node images with packer,
+// uploading them to a node image registry and generating the node-images.yaml file of a cluster stack release.
+package nodeimages
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+)
+
+// OpenStackNodeImage represents the structure of the OpenStackNodeImage.
+type OpenStackNodeImage struct {
+	URL        string      `json:"url" yaml:"url"`
+	ImageDir   string      `json:"imageDir,omitempty" yaml:"imageDir,omitempty"`
+	ImageID    string      `json:"imageID,omitempty" yaml:"imageID,omitempty"` //nolint:tagliatelle // using 'imageID' instead of 'imageId'
+	CreateOpts *CreateOpts `json:"createOpts" yaml:"createOpts"`
+	// ImageSize is the virtual size of the built image in bytes. It is a hint for choosing a flavor with a sufficient disk.
+	ImageSize int64 `json:"image_size,omitempty" yaml:"image_size,omitempty"` //nolint:tagliatelle // same naming as the Glance properties in createOpts
+	// Checksum contains the checksums of the built image, so the download can be verified.
+	Checksum *Checksum `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+}
+
+// CreateOpts represents options used to create an image.
+type CreateOpts images.CreateOpts
+
+// NodeImages represents the structure of the config.yaml file.
+type NodeImages struct {
+	APIVersion          string                `yaml:"apiVersion"`
+	OpenStackNodeImages []*OpenStackNodeImage `yaml:"openStackNodeImages"`
+}
+
+// GetConfig returns Config.
+func GetConfig(configPath string) (*NodeImages, error) {
+	configFileData, err := os.ReadFile(filepath.Clean(configPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	nd := NodeImages{}
+	if err := yaml.Unmarshal(configFileData, &nd); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config yaml: %w", err)
+	}
+
+	v := &validator{}
+	v.validateNodeImages(newYAMLSource(configPath, configFileData), &nd)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	return &nd, nil
+}
+
+// ValidateRenderedConfig validates the node images read from the config file at configPath after their templates were
+// rendered with RenderTemplates. GetConfig skips the values containing templates, so the rendered values are checked
+// against the restrictions of Glance here.
+func ValidateRenderedConfig(configPath string, nodeImages *NodeImages) error {
+	configFileData, err := os.ReadFile(filepath.Clean(configPath))
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	v := &validator{}
+	v.validateNodeImages(newYAMLSource(configPath, configFileData), nodeImages)
+	return v.err()
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+)
+
+const (
+	// maxImageNameLength is the maximum length of an image name accepted by Glance.
+	maxImageNameLength = 255
+	// maxTagLength is the maximum length of an image tag accepted by Glance.
+	maxTagLength = 255
+	// maxTags is the default number of tags per image allowed by Glance (image_tag_quota).
+	maxTags = 128
+	// maxMinValue is the maximum value of min_disk and min_ram accepted by Glance.
+	maxMinValue = 1<<31 - 1
+	// maxSuggestionDistance is the maximum edit distance of a suggestion for an invalid value.
+	maxSuggestionDistance = 2
+)
+
+// DiskFormats contains the disk formats supported by Glance.
+var DiskFormats = []string{"ami", "ari", "aki", "vhd", "vhdx", "vmdk", "raw", "qcow2", "vdi", "iso", "ploop"}
+
+// ContainerFormats contains the container formats supported by Glance.
+var ContainerFormats = []string{"ami", "ari", "aki", "bare", "ovf", "ova", "docker", "compressed"}
+
+// Visibilities contains the image visibilities supported by Glance.
+var Visibilities = []string{
+	string(images.ImageVisibilityPublic),
+	string(images.ImageVisibilityPrivate),
+	string(images.ImageVisibilityShared),
+	string(images.ImageVisibilityCommunity),
+}
+
+// amazonFormats are formats which have to be used both as disk and container format.
+var amazonFormats = []string{"ami", "ari", "aki"}
+
+// validateCreateOpts validates the CreateOpts of the node image at the YAML path against the values accepted by Glance.
+// Templates in the name and tags are skipped, they are validated once they are rendered.
+func (v *validator) validateCreateOpts(source *yamlSource, createOptsPath string, createOpts *CreateOpts) {
+	switch {
+	case isTemplate(createOpts.Name):
+	case len(createOpts.Name) > maxImageNameLength:
+		v.addf(source, createOptsPath+".name", "field 'name' %q in CreateOpts must not be longer than %d characters", createOpts.Name, maxImageNameLength)
+	}
+
+	if createOpts.DiskFormat != "" {
+		v.validateEnum(source, createOptsPath+".disk_format", "disk_format", createOpts.DiskFormat, DiskFormats)
+	}
+	if createOpts.ContainerFormat != "" {
+		v.validateEnum(source, createOptsPath+".container_format", "container_format", createOpts.ContainerFormat, ContainerFormats)
+	}
+	if slices.Contains(amazonFormats, createOpts.ContainerFormat) && createOpts.DiskFormat != createOpts.ContainerFormat {
+		v.addf(source, createOptsPath+".disk_format", "field 'disk_format' in CreateOpts must be %q when 'container_format' is %q", createOpts.ContainerFormat, createOpts.ContainerFormat)
+	}
+	if createOpts.Visibility != nil {
+		v.validateEnum(source, createOptsPath+".visibility", "visibility", string(*createOpts.Visibility), Visibilities)
+	}
+
+	if createOpts.MinDisk < 0 || createOpts.MinDisk > maxMinValue {
+		v.addf(source, createOptsPath+".min_disk", "field 'min_disk' in CreateOpts must be between 0 and %d GiB, got %d", maxMinValue, createOpts.MinDisk)
+	}
+	if createOpts.MinRAM < 0 || createOpts.MinRAM > maxMinValue {
+		v.addf(source, createOptsPath+".min_ram", "field 'min_ram' in CreateOpts must be between 0 and %d MiB, got %d", maxMinValue, createOpts.MinRAM)
+	}
+
+	v.validateTags(source, createOptsPath+".tags", createOpts.Tags)
+}
+
+// validateEnum validates that the value of the field is one of the allowed values and suggests the closest one otherwise.
+func (v *validator) validateEnum(source *yamlSource, yamlPath, field, value string, allowed []string) {
+	if slices.Contains(allowed, value) {
+		return
+	}
+	if suggestion := suggest(value, allowed); suggestion != "" {
+		v.addf(source, yamlPath, "invalid %s %q in CreateOpts, did you mean %q?", field, value, suggestion)
+		return
+	}
+	v.addf(source, yamlPath, "invalid %s %q in CreateOpts, expected one of %s", field, value, strings.Join(allowed, ", "))
+}
+
+// validateTags validates the image tags against the restrictions of Glance.
+func (v *validator) validateTags(source *yamlSource, tagsPath string, tags []string) {
+	if len(tags) > maxTags {
+		v.addf(source, tagsPath, "field 'tags' in CreateOpts must not contain more than %d tags", maxTags)
+	}
+
+	seen := make(map[string]bool, len(tags))
+	for i, tag := range tags {
+		tagPath := fmt.Sprintf("%s[%d]", tagsPath, i)
+		switch {
+		case isTemplate(tag):
+			continue
+		case strings.TrimSpace(tag) == "":
+			v.addf(source, tagPath, "tag must not be empty")
+		case strings.TrimSpace(tag) != tag:
+			v.addf(source, tagPath, "tag %q must not start or end with whitespace", tag)
+		case len(tag) > maxTagLength:
+			v.addf(source, tagPath, "tag %q must not be longer than %d characters", tag, maxTagLength)
+		case strings.Contains(tag, "/"):
+			v.addf(source, tagPath, "tag %q must not contain '/'", tag)
+		case seen[tag]:
+			v.addf(source, tagPath, "duplicate tag %q", tag)
+		}
+		seen[tag] = true
+	}
+}
+
+// suggest returns the allowed value closest to the given value, or an empty string if none is close enough.
+func suggest(value string, allowed []string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	// short values would match almost every candidate, so the allowed distance depends on the length
+	suggestion := ""
+	bestDistance := min(maxSuggestionDistance, len(value)/2) + 1
+	for _, candidate := range allowed {
+		if distance := levenshtein(value, candidate); distance < bestDistance {
+			suggestion, bestDistance = candidate, distance
+		}
+	}
+	return suggestion
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
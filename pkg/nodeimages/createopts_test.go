@@ -0,0 +1,87 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+)
+
+func TestValidateCreateOpts(t *testing.T) {
+	visibility := func(v string) *images.ImageVisibility {
+		visibility := images.ImageVisibility(v)
+		return &visibility
+	}
+
+	tests := []struct {
+		name       string
+		createOpts CreateOpts
+		wantErr    string
+	}{
+		{name: "valid", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "qcow2", ContainerFormat: "bare", Visibility: visibility("public"), Tags: []string{"kube"}}},
+		{name: "disk format typo", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "qcwo2", ContainerFormat: "bare"}, wantErr: `invalid disk_format "qcwo2" in CreateOpts, did you mean "qcow2"?`},
+		{name: "disk format upper case", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "QCOW2", ContainerFormat: "bare"}, wantErr: `did you mean "qcow2"?`},
+		{name: "unknown disk format", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "squashfs", ContainerFormat: "bare"}, wantErr: `invalid disk_format "squashfs" in CreateOpts, expected one of ami, ari`},
+		{name: "container format typo", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "raw", ContainerFormat: "bar"}, wantErr: `did you mean "bare"?`},
+		{name: "visibility typo", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "raw", ContainerFormat: "bare", Visibility: visibility("pubilc")}, wantErr: `invalid visibility "pubilc" in CreateOpts, did you mean "public"?`},
+		{name: "amazon formats", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "raw", ContainerFormat: "ami"}, wantErr: `field 'disk_format' in CreateOpts must be "ami"`},
+		{name: "negative min_disk", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "raw", ContainerFormat: "bare", MinDisk: -1}, wantErr: "field 'min_disk' in CreateOpts must be between 0"},
+		{name: "negative min_ram", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "raw", ContainerFormat: "bare", MinRAM: -1}, wantErr: "field 'min_ram' in CreateOpts must be between 0"},
+		{name: "name too long", createOpts: CreateOpts{Name: strings.Repeat("a", 256), DiskFormat: "raw", ContainerFormat: "bare"}, wantErr: "must not be longer than 255 characters"},
+		{name: "empty tag", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "raw", ContainerFormat: "bare", Tags: []string{" "}}, wantErr: "tag must not be empty"},
+		{name: "tag with whitespace", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "raw", ContainerFormat: "bare", Tags: []string{"kube "}}, wantErr: `tag "kube " must not start or end with whitespace`},
+		{name: "duplicate tag", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "raw", ContainerFormat: "bare", Tags: []string{"kube", "kube"}}, wantErr: `duplicate tag "kube"`},
+		{name: "template tag", createOpts: CreateOpts{Name: "ubuntu", DiskFormat: "raw", ContainerFormat: "bare", Tags: []string{"{{ .ClusterStackName }}"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &validator{}
+			v.validateCreateOpts(newYAMLSource("config.yaml", nil), "$.openStackNodeImages[0].createOpts", &tt.createOpts)
+			err := v.err()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "qcow", want: "qcow2"},
+		{value: " Raw ", want: "raw"},
+		{value: "vhdxx", want: "vhdx"},
+		{value: "xy", want: ""},
+		{value: "openstack", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := suggest(tt.value, DiskFormats); got != tt.want {
+				t.Errorf("suggestion for %q is %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
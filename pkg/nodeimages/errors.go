@@ -0,0 +1,41 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrConfigInvalid is returned if csctl.yaml, config.yaml, registry.yaml or the given paths are invalid.
+	ErrConfigInvalid = errors.New("invalid configuration")
+	// ErrWrongProvider is returned if the cluster stack is not configured for the OpenStack provider.
+	ErrWrongProvider = errors.New("wrong provider")
+	// ErrBuildFailed is returned if packer failed to build a node image.
+	ErrBuildFailed = errors.New("node image build failed")
+	// ErrUploadFailed is returned if a node image could not be uploaded, e.g. because of wrong credentials.
+	ErrUploadFailed = errors.New("node image upload failed")
+	// ErrURLUpdateFailed is returned if the node image URLs could not be written.
+	ErrURLUpdateFailed = errors.New("node image URL update failed")
+	// ErrURLVerificationFailed is returned if a node image URL is not reachable or its checksum does not match.
+	ErrURLVerificationFailed = errors.New("node image URL verification failed")
+	// ErrLocked is returned if another run holds the lock on the cluster stack directory.
+	ErrLocked = errors.New("cluster stack is locked")
+)
+
+// wrapError marks err with the given sentinel error.
+func wrapError(sentinel, err error) error {
+	return fmt.Errorf("%w: %w", sentinel, err)
+}
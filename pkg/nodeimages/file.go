@@ -0,0 +1,248 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	yaml "github.com/goccy/go-yaml"
+)
+
+// configFileMu serializes the updates of config.yaml by concurrent builds.
+var configFileMu sync.Mutex
+
+// updateURLNodeImages sets the URL of the node image at the given position if it does not have one yet.
+// It reports whether the URL was updated.
+func updateURLNodeImages(configFilePath, newURL string, imageOrder int) (bool, error) {
+	// Check if the URL already exists for the given image
+	imageURLExists := false
+	err := updateNodeImage(configFilePath, imageOrder, func(image *OpenStackNodeImage) {
+		imageURLExists = image.URL != ""
+		// If the URL doesn't exist, update it for the image
+		if !imageURLExists {
+			image.URL = newURL
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	return !imageURLExists, nil
+}
+
+func updateImageIDNodeImages(configFilePath, imageID string, imageOrder int) error {
+	// Every upload creates a new image, so the image ID is always replaced
+	return updateNodeImage(configFilePath, imageOrder, func(image *OpenStackNodeImage) {
+		image.ImageID = imageID
+	})
+}
+
+// updateNodeImage applies the update to the node image at the given position in the config file.
+// The file is edited in place, so only the changed fields are rewritten and comments, formatting and
+// fields unknown to the plugin are kept.
+func updateNodeImage(configFilePath string, imageOrder int, update func(image *OpenStackNodeImage)) error {
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+
+	// #nosec G304
+	nodeImageData, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", filepath.Base(configFilePath), err)
+	}
+	var nodeImages NodeImages
+	if err := yaml.Unmarshal(nodeImageData, &nodeImages); err != nil {
+		return fmt.Errorf("failed to unmarshal YAML: %w", err)
+	}
+	if imageOrder >= len(nodeImages.OpenStackNodeImages) {
+		return fmt.Errorf("node image %d does not exist in %s", imageOrder, filepath.Base(configFilePath))
+	}
+
+	image := nodeImages.OpenStackNodeImages[imageOrder]
+	before, err := toMapSlice(image)
+	if err != nil {
+		return err
+	}
+	update(image)
+	after, err := toMapSlice(image)
+	if err != nil {
+		return err
+	}
+
+	updatedNodeImageData, err := updateYAML(nodeImageData, fmt.Sprintf("$.openStackNodeImages[%d]", imageOrder), before, after)
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", filepath.Base(configFilePath), err)
+	}
+	if bytes.Equal(updatedNodeImageData, nodeImageData) {
+		return nil
+	}
+	if err := writeFileAtomic(configFilePath, updatedNodeImageData); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(configFilePath), err)
+	}
+	return nil
+}
+
+// snapshotFile reads the file and returns a function which restores its current content.
+func snapshotFile(filePath string) (func() error, error) {
+	// #nosec G304
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	return func() error {
+		configFileMu.Lock()
+		defer configFileMu.Unlock()
+
+		if err := writeFileAtomic(filePath, data); err != nil {
+			return fmt.Errorf("error restoring file: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+func copyFile(src, dest string) error {
+	// #nosec G304
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("error reading source file: %w", err)
+	}
+
+	if err := writeFileAtomic(dest, data); err != nil {
+		return fmt.Errorf("error writing to destination file: %w", err)
+	}
+
+	return nil
+}
+
+// renderNodeImagesFile writes the node images file src with rendered templates to dest. Only the templated values
+// are replaced, the rest of the file is copied unchanged.
+func renderNodeImagesFile(src, dest string, data *TemplateData) error {
+	return editNodeImagesFile(src, dest, data.render)
+}
+
+// writeNodeImagesFile writes the node images file src to dest with the values of the given node images, which must
+// be in the same order as in src. Only the changed values are replaced, so comments, formatting and fields unknown to
+// the plugin are kept.
+func writeNodeImagesFile(src, dest string, nodeImages *NodeImages) error {
+	return editNodeImagesFile(src, dest, func(imageOrder int, image *OpenStackNodeImage) error {
+		if imageOrder >= len(nodeImages.OpenStackNodeImages) {
+			return fmt.Errorf("node image %d does not exist", imageOrder)
+		}
+		*image = *nodeImages.OpenStackNodeImages[imageOrder]
+		return nil
+	})
+}
+
+// editNodeImagesFile applies the update to every node image of the node images file src and writes the edited file
+// to dest.
+func editNodeImagesFile(src, dest string, update func(imageOrder int, image *OpenStackNodeImage) error) error {
+	// #nosec G304
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("error reading source file: %w", err)
+	}
+	var nodeImages NodeImages
+	if err := yaml.Unmarshal(content, &nodeImages); err != nil {
+		return fmt.Errorf("failed to unmarshal YAML: %w", err)
+	}
+
+	for i, image := range nodeImages.OpenStackNodeImages {
+		before, err := toMapSlice(image)
+		if err != nil {
+			return err
+		}
+		if err := update(i, image); err != nil {
+			return err
+		}
+		after, err := toMapSlice(image)
+		if err != nil {
+			return err
+		}
+		content, err = updateYAML(content, fmt.Sprintf("$.openStackNodeImages[%d]", i), before, after)
+		if err != nil {
+			return fmt.Errorf("failed to update %s: %w", filepath.Base(src), err)
+		}
+	}
+
+	if err := writeFileAtomic(dest, content); err != nil {
+		return fmt.Errorf("error writing to destination file: %w", err)
+	}
+	return nil
+}
+
+// backupFile copies the file to a file with the suffix .bak.
+func backupFile(filePath string) error {
+	if err := copyFile(filePath, filePath+".bak"); err != nil {
+		return fmt.Errorf("error creating backup of %s: %w", filepath.Base(filePath), err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file in the directory of the file, syncs it to disk and renames it
+// to the file, so the file is never left partially written. The permissions of an existing file are kept.
+func writeFileAtomic(filePath string, data []byte) error {
+	// Replace the target of a symlink instead of the symlink itself
+	if resolvedPath, err := filepath.EvalSymlinks(filePath); err == nil {
+		filePath = resolvedPath
+	}
+	perm := os.FileMode(0o644)
+	if fileInfo, err := os.Stat(filePath); err == nil {
+		perm = fileInfo.Mode().Perm()
+	}
+
+	dir := filepath.Dir(filePath)
+	tmpFile, err := os.CreateTemp(dir, "."+filepath.Base(filePath)+".*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		return fmt.Errorf("error writing temporary file: %w", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("error syncing temporary file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("error writing temporary file: %w", err)
+	}
+	if err := os.Chmod(tmpFile.Name(), perm); err != nil {
+		return fmt.Errorf("error setting permissions of temporary file: %w", err)
+	}
+	if err := os.Rename(tmpFile.Name(), filePath); err != nil {
+		return fmt.Errorf("error renaming temporary file: %w", err)
+	}
+
+	// Sync the directory, so the rename survives a crash as well. Not every platform supports it.
+	_ = syncDir(dir)
+	return nil
+}
+
+// syncDir syncs the directory to disk, which persists the creation, removal and renaming of its entries.
+func syncDir(dir string) error {
+	// #nosec G304
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error opening directory: %w", err)
+	}
+	defer dirFile.Close()
+
+	if err := dirFile.Sync(); err != nil {
+		return fmt.Errorf("error syncing directory: %w", err)
+	}
+	return nil
+}
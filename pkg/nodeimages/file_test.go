@@ -0,0 +1,127 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		perm     os.FileMode
+		symlink  bool
+		wantPerm os.FileMode
+	}{
+		{name: "new file", wantPerm: 0o644},
+		{name: "existing file", existing: true, perm: 0o644, wantPerm: 0o644},
+		{name: "existing private file", existing: true, perm: 0o600, wantPerm: 0o600},
+		{name: "symlink", existing: true, perm: 0o640, symlink: true, wantPerm: 0o640},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if runtime.GOOS == "windows" && (tt.perm != 0o644 || tt.symlink) {
+				t.Skip("permissions and symlinks are not supported on windows")
+			}
+			dir := t.TempDir()
+			targetPath := filepath.Join(dir, "config.yaml")
+			if tt.existing {
+				writeFile(t, targetPath, "old content\n", tt.perm)
+			}
+			filePath := targetPath
+			if tt.symlink {
+				linkDir := t.TempDir()
+				filePath = filepath.Join(linkDir, "config.yaml")
+				if err := os.Symlink(targetPath, filePath); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := writeFileAtomic(filePath, []byte("new content\n")); err != nil {
+				t.Fatalf("writing file failed: %v", err)
+			}
+
+			data, err := os.ReadFile(targetPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "new content\n" {
+				t.Errorf("content is %q, want %q", data, "new content\n")
+			}
+			fileInfo, err := os.Stat(targetPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if runtime.GOOS != "windows" && fileInfo.Mode().Perm() != tt.wantPerm {
+				t.Errorf("permissions are %o, want %o", fileInfo.Mode().Perm(), tt.wantPerm)
+			}
+			if tt.symlink {
+				// The symlink is kept and points to the written file
+				linkInfo, err := os.Lstat(filePath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if linkInfo.Mode()&os.ModeSymlink == 0 {
+					t.Errorf("%s is no symlink anymore", filePath)
+				}
+				assertDirEntries(t, filepath.Dir(filePath), "config.yaml")
+			}
+
+			// The temporary file is renamed, nothing else is left in the directory
+			assertDirEntries(t, dir, "config.yaml")
+		})
+	}
+}
+
+func TestWriteFileAtomicMissingDirectory(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "missing", "config.yaml")
+	if err := writeFileAtomic(filePath, []byte("content\n")); err == nil {
+		t.Fatal("expected error writing into missing directory")
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directories cannot be synced on windows")
+	}
+	dir := t.TempDir()
+	if err := syncDir(dir); err != nil {
+		t.Errorf("syncing directory failed: %v", err)
+	}
+	if err := syncDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error syncing missing directory")
+	}
+}
+
+// assertDirEntries checks that the directory contains exactly the given entries.
+func assertDirEntries(t *testing.T, dir string, wantNames ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !slices.Equal(names, wantNames) {
+		t.Errorf("%s contains %v, want %v", dir, names, wantNames)
+	}
+}
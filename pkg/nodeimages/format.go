@@ -0,0 +1,176 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DiskFormatQCOW2 is the disk format of QEMU copy-on-write images.
+	DiskFormatQCOW2 = "qcow2"
+	// DiskFormatRaw is the disk format of raw disk images.
+	DiskFormatRaw = "raw"
+	// DiskFormatVMDK is the disk format of VMware virtual disks.
+	DiskFormatVMDK = "vmdk"
+	// DiskFormatVHD is the disk format of Microsoft virtual hard disks.
+	DiskFormatVHD = "vhd"
+	// DiskFormatVHDX is the disk format of Microsoft Hyper-V virtual hard disks.
+	DiskFormatVHDX = "vhdx"
+	// DiskFormatVDI is the disk format of VirtualBox disk images.
+	DiskFormatVDI = "vdi"
+	// DiskFormatISO is the disk format of ISO 9660 optical disc images.
+	DiskFormatISO = "iso"
+
+	// vhdFooterSize is the size of the footer at the end of VHD images.
+	vhdFooterSize = 512
+	// vdiSignatureOffset is the offset of the signature in the header of VDI images.
+	vdiSignatureOffset = 0x40
+	// isoMagicOffset is the offset of the identifier of the first volume descriptor of ISO images.
+	isoMagicOffset = 0x8001
+	// qcow2SizeOffset is the offset of the virtual size in the header of qcow2 images.
+	qcow2SizeOffset = 24
+
+	// GiB is the size of a gibibyte in bytes.
+	GiB = 1 << 30
+)
+
+var (
+	qcow2Magic          = []byte("QFI\xfb")
+	vmdkSparseMagic     = []byte("KDMV")
+	vmdkDescriptorMagic = []byte("# Disk DescriptorFile")
+	vhdxMagic           = []byte("vhdxfile")
+	vhdMagic            = []byte("conectix")
+	isoMagic            = []byte("CD001")
+	vdiSignature        = uint32(0xbeda107f)
+)
+
+// detectableDiskFormats are the disk formats DetectDiskFormat can distinguish.
+// Other formats like ami or ploop are not checked against the artifact.
+var detectableDiskFormats = []string{
+	DiskFormatQCOW2, DiskFormatRaw, DiskFormatVMDK, DiskFormatVHD, DiskFormatVHDX, DiskFormatVDI, DiskFormatISO,
+}
+
+// DetectDiskFormat returns the disk format of the image file by looking at its header.
+// Files without a known header are reported as raw.
+func DetectDiskFormat(filePath string) (string, error) {
+	file, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return "", fmt.Errorf("error opening image file: %w", err)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("error getting image file info: %w", err)
+	}
+
+	header := make([]byte, vdiSignatureOffset+4)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("error reading image header: %w", err)
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, qcow2Magic):
+		return DiskFormatQCOW2, nil
+	case bytes.HasPrefix(header, vmdkSparseMagic), bytes.HasPrefix(header, vmdkDescriptorMagic):
+		return DiskFormatVMDK, nil
+	case bytes.HasPrefix(header, vhdxMagic):
+		return DiskFormatVHDX, nil
+	case bytes.HasPrefix(header, vhdMagic):
+		// dynamic VHD images start with a copy of the footer
+		return DiskFormatVHD, nil
+	case len(header) == vdiSignatureOffset+4 && binary.LittleEndian.Uint32(header[vdiSignatureOffset:]) == vdiSignature:
+		return DiskFormatVDI, nil
+	}
+
+	ok, err := hasMagicAt(file, isoMagic, isoMagicOffset, fileInfo.Size())
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return DiskFormatISO, nil
+	}
+
+	// fixed VHD images only have a footer
+	ok, err = hasMagicAt(file, vhdMagic, fileInfo.Size()-vhdFooterSize, fileInfo.Size())
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return DiskFormatVHD, nil
+	}
+
+	return DiskFormatRaw, nil
+}
+
+// hasMagicAt reports whether the file contains magic at the offset.
+func hasMagicAt(file *os.File, magic []byte, offset, size int64) (bool, error) {
+	if offset < 0 || offset+int64(len(magic)) > size {
+		return false, nil
+	}
+	buf := make([]byte, len(magic))
+	if _, err := file.ReadAt(buf, offset); err != nil {
+		return false, fmt.Errorf("error reading image file: %w", err)
+	}
+	return bytes.Equal(buf, magic), nil
+}
+
+// VirtualSize returns the size in bytes of the disk represented by the image file.
+// For qcow2 images, it is read from the header, for raw images it is the file size.
+func VirtualSize(filePath, diskFormat string) (int64, error) {
+	file, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return 0, fmt.Errorf("error opening image file: %w", err)
+	}
+	defer file.Close()
+
+	switch diskFormat {
+	case DiskFormatQCOW2:
+		header := make([]byte, qcow2SizeOffset+8)
+		if _, err := io.ReadFull(file, header); err != nil {
+			return 0, fmt.Errorf("error reading qcow2 header: %w", err)
+		}
+		if !bytes.HasPrefix(header, qcow2Magic) {
+			return 0, fmt.Errorf("%s is not a qcow2 image", filePath)
+		}
+		size := binary.BigEndian.Uint64(header[qcow2SizeOffset:])
+		if size > math.MaxInt64 {
+			return 0, fmt.Errorf("invalid virtual size %d in qcow2 header", size)
+		}
+		return int64(size), nil
+	case DiskFormatRaw:
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return 0, fmt.Errorf("error getting image file info: %w", err)
+		}
+		return fileInfo.Size(), nil
+	default:
+		return 0, fmt.Errorf("virtual size of disk format %s is not supported", diskFormat)
+	}
+}
+
+// sizeToGiB returns the size in GiB, rounded up.
+func sizeToGiB(size int64) int {
+	return int((size + GiB - 1) / GiB)
+}
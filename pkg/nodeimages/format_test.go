@@ -0,0 +1,215 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeTestImage writes an image file of the given size with data at the given offsets.
+func writeTestImage(t *testing.T, size int64, data map[int64][]byte) string {
+	t.Helper()
+	content := make([]byte, size)
+	for offset, value := range data {
+		copy(content[offset:], value)
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(imagePath, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return imagePath
+}
+
+func TestDetectDiskFormat(t *testing.T) {
+	vdiHeader := make([]byte, 4)
+	binary.LittleEndian.PutUint32(vdiHeader, vdiSignature)
+
+	tests := []struct {
+		name string
+		size int64
+		data map[int64][]byte
+		want string
+	}{
+		{name: "qcow2", size: 1024, data: map[int64][]byte{0: qcow2Magic}, want: DiskFormatQCOW2},
+		{name: "sparse vmdk", size: 1024, data: map[int64][]byte{0: vmdkSparseMagic}, want: DiskFormatVMDK},
+		{name: "vmdk descriptor", size: 1024, data: map[int64][]byte{0: vmdkDescriptorMagic}, want: DiskFormatVMDK},
+		{name: "vhdx", size: 1024, data: map[int64][]byte{0: vhdxMagic}, want: DiskFormatVHDX},
+		{name: "dynamic vhd", size: 2048, data: map[int64][]byte{0: vhdMagic}, want: DiskFormatVHD},
+		{name: "fixed vhd", size: 2048, data: map[int64][]byte{2048 - vhdFooterSize: vhdMagic}, want: DiskFormatVHD},
+		{name: "vdi", size: 1024, data: map[int64][]byte{vdiSignatureOffset: vdiHeader}, want: DiskFormatVDI},
+		{name: "iso", size: 0x9000, data: map[int64][]byte{isoMagicOffset: isoMagic}, want: DiskFormatISO},
+		{name: "raw", size: 1024, want: DiskFormatRaw},
+		{name: "empty", size: 0, want: DiskFormatRaw},
+		{name: "smaller than header", size: 3, data: map[int64][]byte{0: []byte("QFI")}, want: DiskFormatRaw},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diskFormat, err := DetectDiskFormat(writeTestImage(t, tt.size, tt.data))
+			if err != nil {
+				t.Fatalf("detection failed: %v", err)
+			}
+			if diskFormat != tt.want {
+				t.Errorf("disk format is %q, want %q", diskFormat, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDiskFormat(t *testing.T) {
+	qcow2Path := writeTestImage(t, 1024, map[int64][]byte{0: qcow2Magic})
+
+	tests := []struct {
+		name          string
+		diskFormat    string
+		fixDiskFormat bool
+		wantCorrected bool
+		wantFormat    string
+		wantErr       error
+	}{
+		{name: "matching", diskFormat: DiskFormatQCOW2, wantFormat: DiskFormatQCOW2},
+		{name: "mismatch", diskFormat: DiskFormatRaw, wantFormat: DiskFormatRaw, wantErr: ErrConfigInvalid},
+		{name: "mismatch corrected", diskFormat: DiskFormatRaw, fixDiskFormat: true, wantCorrected: true, wantFormat: DiskFormatQCOW2},
+		{name: "not detectable", diskFormat: "ploop", wantFormat: "ploop"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := NewOrchestrator(Options{FixDiskFormat: tt.fixDiskFormat, Out: &bytes.Buffer{}})
+			image := &OpenStackNodeImage{CreateOpts: &CreateOpts{Name: "ubuntu", DiskFormat: tt.diskFormat}}
+
+			corrected, err := o.checkDiskFormat(image, qcow2Path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if corrected != tt.wantCorrected {
+				t.Errorf("corrected is %t, want %t", corrected, tt.wantCorrected)
+			}
+			if image.CreateOpts.DiskFormat != tt.wantFormat {
+				t.Errorf("disk_format is %q, want %q", image.CreateOpts.DiskFormat, tt.wantFormat)
+			}
+		})
+	}
+}
+
+// qcow2Header returns the beginning of a qcow2 header with the given virtual size.
+func qcow2Header(virtualSize uint64) []byte {
+	header := make([]byte, qcow2SizeOffset+8)
+	copy(header, qcow2Magic)
+	binary.BigEndian.PutUint64(header[qcow2SizeOffset:], virtualSize)
+	return header
+}
+
+func TestVirtualSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int64
+		data       map[int64][]byte
+		diskFormat string
+		want       int64
+		wantErr    bool
+	}{
+		{name: "qcow2", size: 1024, data: map[int64][]byte{0: qcow2Header(20 * GiB)}, diskFormat: DiskFormatQCOW2, want: 20 * GiB},
+		{name: "raw", size: 4096, diskFormat: DiskFormatRaw, want: 4096},
+		{name: "qcow2 without magic", size: 1024, diskFormat: DiskFormatQCOW2, wantErr: true},
+		{name: "truncated qcow2 header", size: 8, data: map[int64][]byte{0: qcow2Magic}, diskFormat: DiskFormatQCOW2, wantErr: true},
+		{name: "virtual size too large", size: 1024, data: map[int64][]byte{0: qcow2Header(1 << 63)}, diskFormat: DiskFormatQCOW2, wantErr: true},
+		{name: "unsupported format", size: 1024, diskFormat: DiskFormatVMDK, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, err := VirtualSize(writeTestImage(t, tt.size, tt.data), tt.diskFormat)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got size %d", size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading virtual size failed: %v", err)
+			}
+			if size != tt.want {
+				t.Errorf("virtual size is %d, want %d", size, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetImageSize(t *testing.T) {
+	const nodeImages = `apiVersion: v1
+openStackNodeImages:
+  - url: ""
+    imageDir: ubuntu
+    createOpts:
+      name: ubuntu
+      disk_format: qcow2
+      container_format: bare
+      min_disk: MIN_DISK
+`
+
+	tests := []struct {
+		name        string
+		minDisk     int
+		virtualSize uint64
+		wantMinDisk int
+		wantWarning bool
+	}{
+		{name: "min_disk not set", virtualSize: 20 * GiB, wantMinDisk: 20},
+		{name: "rounded up", virtualSize: 20*GiB + 1, wantMinDisk: 21},
+		{name: "min_disk larger", minDisk: 30, virtualSize: 20 * GiB, wantMinDisk: 30},
+		{name: "min_disk smaller", minDisk: 10, virtualSize: 20 * GiB, wantMinDisk: 10, wantWarning: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			releaseDir := t.TempDir()
+			content := bytes.ReplaceAll([]byte(nodeImages), []byte("MIN_DISK"), []byte(strconv.Itoa(tt.minDisk)))
+			if err := os.WriteFile(filepath.Join(releaseDir, "node-images.yaml"), content, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			out := &bytes.Buffer{}
+			o := NewOrchestrator(Options{ReleaseDir: releaseDir, Out: out})
+			image := &OpenStackNodeImage{CreateOpts: &CreateOpts{Name: "ubuntu", DiskFormat: DiskFormatQCOW2, MinDisk: tt.minDisk}}
+
+			imagePath := writeTestImage(t, 1024, map[int64][]byte{0: qcow2Header(tt.virtualSize)})
+			if err := o.setImageSize(image, 0, imagePath); err != nil {
+				t.Fatalf("setting image size failed: %v", err)
+			}
+
+			if image.CreateOpts.MinDisk != tt.wantMinDisk || image.ImageSize != int64(tt.virtualSize) {
+				t.Errorf("min_disk is %d and image_size %d, want %d and %d", image.CreateOpts.MinDisk, image.ImageSize, tt.wantMinDisk, tt.virtualSize)
+			}
+			if warning := strings.Contains(out.String(), "Warning:"); warning != tt.wantWarning {
+				t.Errorf("output %q contains a warning: %t, want %t", out.String(), warning, tt.wantWarning)
+			}
+
+			recorded, err := GetConfig(o.NodeImagesPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			recordedImage := recorded.OpenStackNodeImages[0]
+			if recordedImage.CreateOpts.MinDisk != tt.wantMinDisk || recordedImage.ImageSize != int64(tt.virtualSize) {
+				t.Errorf("recorded min_disk is %d and image_size %d, want %d and %d", recordedImage.CreateOpts.MinDisk, recordedImage.ImageSize, tt.wantMinDisk, tt.virtualSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/imagedata"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/imageimport"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+)
+
+// errGlanceCreateOptsRequired is returned if an object is uploaded to Glance without image create options.
+var errGlanceCreateOptsRequired = errors.New("uploading to Glance requires image create options")
+
+// errImageImportFailed is returned if Glance could not import an image.
+var errImageImportFailed = errors.New("image import failed")
+
+// importPollInterval is the interval in which the status of an imported image is checked.
+const importPollInterval = 10 * time.Second
+
+// glanceRegistry is a Registry which uploads node images directly into the OpenStack image service.
+// Objects are identified by the image name.
+type glanceRegistry struct {
+	client *gophercloud.ServiceClient
+	// pollInterval is the interval in which the status of an imported image is checked.
+	pollInterval time.Duration
+}
+
+var (
+	_ ImageRegistry = &glanceRegistry{}
+	_ ImageImporter = &glanceRegistry{}
+)
+
+// newGlanceRegistry returns a Glance registry. The given context is used for all requests of the registry.
+// The image service endpoint is taken from the service catalog unless `endpoint` is defined in registry.yaml.
+func newGlanceRegistry(ctx context.Context, registryConfig *RegistryConfig) (Registry, error) {
+	providerClient, err := newProviderClient(ctx, registryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var client *gophercloud.ServiceClient
+	if registryConfig.Config.Endpoint != "" {
+		client = &gophercloud.ServiceClient{
+			ProviderClient: providerClient,
+			Endpoint:       endpointURL(registryConfig) + "/",
+			Type:           "image",
+		}
+		client.ResourceBase = client.Endpoint + "v2/"
+	} else {
+		client, err = openstack.NewImageServiceV2(providerClient, gophercloud.EndpointOpts{Region: region(registryConfig)})
+		if err != nil {
+			return nil, fmt.Errorf("error creating image service client: %w", err)
+		}
+	}
+
+	return &glanceRegistry{client: client, pollInterval: importPollInterval}, nil
+}
+
+func (*glanceRegistry) Upload(_ context.Context, objectName string, _ io.Reader, _ int64) error {
+	return fmt.Errorf("error uploading object %s: %w", objectName, errGlanceCreateOptsRequired)
+}
+
+// UploadImage creates the image and uploads the image data. The image is deleted again if the upload fails.
+func (r *glanceRegistry) UploadImage(ctx context.Context, createOpts *CreateOpts, reader io.Reader, _ int64) (string, error) {
+	if createOpts == nil {
+		return "", errGlanceCreateOptsRequired
+	}
+
+	client := withContext(ctx, r.client)
+	image, err := images.Create(client, images.CreateOpts(*createOpts)).Extract()
+	if err != nil {
+		return "", fmt.Errorf("error creating image %s: %w", createOpts.Name, err)
+	}
+
+	if err := imagedata.Upload(client, image.ID, reader).ExtractErr(); err != nil {
+		err = fmt.Errorf("error uploading data of image %s: %w", createOpts.Name, err)
+		if deleteErr := images.Delete(cleanupClient(r.client), image.ID).ExtractErr(); deleteErr != nil {
+			err = errors.Join(err, fmt.Errorf("error deleting image %s after failed upload: %w", image.ID, deleteErr))
+		}
+		return "", err
+	}
+
+	return image.ID, nil
+}
+
+// UpdateImageProperties adds the properties to the image or replaces their values.
+func (r *glanceRegistry) UpdateImageProperties(ctx context.Context, imageID string, properties map[string]string) error {
+	updateOpts := make(images.UpdateOpts, 0, len(properties))
+	for name, value := range properties {
+		// add replaces the value of an existing property
+		updateOpts = append(updateOpts, images.UpdateImageProperty{Op: images.AddOp, Name: name, Value: value})
+	}
+	if _, err := images.Update(withContext(ctx, r.client), imageID, updateOpts).Extract(); err != nil {
+		return fmt.Errorf("error updating properties of image %s: %w", imageID, err)
+	}
+	return nil
+}
+
+// ImportImage creates the image and imports the image data from the URL using the web-download method
+// of the Glance interoperable image import. It waits until the image becomes active and returns the image ID.
+// The image is deleted again if the import fails.
+func (r *glanceRegistry) ImportImage(ctx context.Context, createOpts *CreateOpts, url string) (string, error) {
+	if createOpts == nil {
+		return "", errGlanceCreateOptsRequired
+	}
+
+	client := withContext(ctx, r.client)
+	image, err := images.Create(client, images.CreateOpts(*createOpts)).Extract()
+	if err != nil {
+		return "", fmt.Errorf("error creating image %s: %w", createOpts.Name, err)
+	}
+
+	importOpts := imageimport.CreateOpts{
+		Name: imageimport.WebDownloadMethod,
+		URI:  url,
+	}
+	err = imageimport.Create(client, image.ID, importOpts).ExtractErr()
+	if err == nil {
+		err = r.waitForImage(ctx, image.ID)
+	}
+	if err != nil {
+		err = fmt.Errorf("error importing image %s from %s: %w", createOpts.Name, url, err)
+		if deleteErr := images.Delete(cleanupClient(r.client), image.ID).ExtractErr(); deleteErr != nil {
+			err = errors.Join(err, fmt.Errorf("error deleting image %s after failed import: %w", image.ID, deleteErr))
+		}
+		return "", err
+	}
+	return image.ID, nil
+}
+
+// waitForImage polls the image until it becomes active or the import failed.
+func (r *glanceRegistry) waitForImage(ctx context.Context, imageID string) error {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	client := withContext(ctx, r.client)
+	for {
+		image, err := images.Get(client, imageID).Extract()
+		if err != nil {
+			return fmt.Errorf("error getting image %s: %w", imageID, err)
+		}
+
+		switch image.Status {
+		case images.ImageStatusActive:
+			return nil
+		case images.ImageStatusKilled, images.ImageStatusDeleted, images.ImageStatusPendingDelete, images.ImageStatusDeactivated:
+			return fmt.Errorf("%w: image %s has status %s", errImageImportFailed, imageID, image.Status)
+		case images.ImageStatusQueued, images.ImageStatusSaving, images.ImageStatusImporting:
+		}
+
+		// Glance reports failed imports in this property while the image stays queued
+		if failed, ok := image.Properties["os_glance_failed_import"].(string); ok && failed != "" {
+			return fmt.Errorf("%w: import of image %s failed in stores %s", errImageImportFailed, imageID, failed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("error waiting for image %s: %w", imageID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stat returns information about the most recently created active image with the given name. Images which are not
+// active, e.g. left behind by an interrupted upload, are ignored.
+func (r *glanceRegistry) Stat(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	imageList, err := r.listImages(ctx, images.ListOpts{Name: objectName, Status: images.ImageStatusActive, Sort: "created_at:desc"})
+	if err != nil {
+		return nil, err
+	}
+	if len(imageList) == 0 {
+		return nil, fmt.Errorf("%s: %w", objectName, ErrObjectNotFound)
+	}
+	return imageObjectInfo(&imageList[0]), nil
+}
+
+// Delete deletes all images with the given name.
+func (r *glanceRegistry) Delete(ctx context.Context, objectName string) error {
+	imageList, err := r.listImages(ctx, images.ListOpts{Name: objectName})
+	if err != nil {
+		return err
+	}
+	client := withContext(ctx, r.client)
+	for i := range imageList {
+		if err := images.Delete(client, imageList[i].ID).ExtractErr(); err != nil {
+			return fmt.Errorf("error deleting image %s: %w", imageList[i].ID, err)
+		}
+	}
+	return nil
+}
+
+func (r *glanceRegistry) List(ctx context.Context) ([]ObjectInfo, error) {
+	imageList, err := r.listImages(ctx, images.ListOpts{})
+	if err != nil {
+		return nil, err
+	}
+
+	objectInfos := make([]ObjectInfo, 0, len(imageList))
+	for i := range imageList {
+		objectInfos = append(objectInfos, *imageObjectInfo(&imageList[i]))
+	}
+	return objectInfos, nil
+}
+
+// URL returns an empty string, as images uploaded to Glance are referenced by their ID.
+func (*glanceRegistry) URL(context.Context, string) (string, error) {
+	return "", nil
+}
+
+func (r *glanceRegistry) listImages(ctx context.Context, listOpts images.ListOpts) ([]images.Image, error) {
+	pages, err := images.List(withContext(ctx, r.client), listOpts).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %w", err)
+	}
+	imageList, err := images.ExtractImages(pages)
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %w", err)
+	}
+	return imageList, nil
+}
+
+// imageObjectInfo returns the object info of the image. The string properties of the image are returned as metadata.
+func imageObjectInfo(image *images.Image) *ObjectInfo {
+	objectInfo := &ObjectInfo{
+		Name:         image.Name,
+		Size:         image.SizeBytes,
+		LastModified: image.UpdatedAt,
+		ID:           image.ID,
+	}
+	for key, value := range image.Properties {
+		if value, ok := value.(string); ok {
+			if objectInfo.Metadata == nil {
+				objectInfo.Metadata = make(map[string]string)
+			}
+			objectInfo.Metadata[strings.ToLower(key)] = value
+		}
+	}
+	return objectInfo
+}
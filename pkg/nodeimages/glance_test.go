@@ -0,0 +1,318 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+// fakeGlance is a minimal Glance image API. An imported image reports the statuses of importStatuses one after
+// another, one per request, and keeps the last one. If failedStores is set, it is reported in the
+// os_glance_failed_import property like Glance does when web-download fails.
+type fakeGlance struct {
+	importStatuses []string
+	failedStores   string
+
+	mu          sync.Mutex
+	images      map[string]map[string]interface{}
+	importedURL string
+	deleted     []string
+}
+
+func (g *fakeGlance) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/images")
+	id, action, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	switch {
+	case path == "" && req.Method == http.MethodPost:
+		var image map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&image); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		image["id"] = fmt.Sprintf("image-%d", len(g.images)+len(g.deleted)+1)
+		image["status"] = "queued"
+		g.images[image["id"].(string)] = image
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(image)
+	case path == "" && req.Method == http.MethodGet:
+		// newest images first, like with sort created_at:desc
+		imageList := []map[string]interface{}{}
+		for i := len(g.images) + len(g.deleted); i > 0; i-- {
+			image, ok := g.images[fmt.Sprintf("image-%d", i)]
+			query := req.URL.Query()
+			if !ok || (query.Has("name") && image["name"] != query.Get("name")) || (query.Has("status") && image["status"] != query.Get("status")) {
+				continue
+			}
+			imageList = append(imageList, image)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"images": imageList})
+	case action == "import" && req.Method == http.MethodPost:
+		var importRequest struct {
+			Method struct {
+				Name string `json:"name"`
+				URI  string `json:"uri"`
+			} `json:"method"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&importRequest); err != nil || importRequest.Method.Name != "web-download" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		g.importedURL = importRequest.Method.URI
+		w.WriteHeader(http.StatusAccepted)
+	case action == "file" && req.Method == http.MethodPut:
+		image, ok := g.images[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// Glance computes the multihash of the image data while storing it
+		sum := sha512.Sum512(data)
+		image["status"] = "active"
+		image["size"] = len(data)
+		image["os_hash_algo"] = HashAlgoSHA512
+		image["os_hash_value"] = hex.EncodeToString(sum[:])
+		w.WriteHeader(http.StatusNoContent)
+	case action == "" && req.Method == http.MethodGet:
+		image, ok := g.images[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if len(g.importStatuses) > 0 {
+			image["status"] = g.importStatuses[0]
+			if len(g.importStatuses) > 1 {
+				g.importStatuses = g.importStatuses[1:]
+			}
+		}
+		if g.failedStores != "" {
+			image["os_glance_failed_import"] = g.failedStores
+		}
+		_ = json.NewEncoder(w).Encode(image)
+	case action == "" && req.Method == http.MethodPatch:
+		image, ok := g.images[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var patches []struct {
+			Op    string `json:"op"`
+			Path  string `json:"path"`
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&patches); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, patch := range patches {
+			if patch.Op != "add" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			image[strings.TrimPrefix(patch.Path, "/")] = patch.Value
+		}
+		_ = json.NewEncoder(w).Encode(image)
+	case action == "" && req.Method == http.MethodDelete:
+		delete(g.images, id)
+		g.deleted = append(g.deleted, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestGlanceRegistry(t *testing.T, fake *fakeGlance) *glanceRegistry {
+	t.Helper()
+	fake.images = map[string]map[string]interface{}{}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{HTTPClient: *server.Client()},
+		Endpoint:       server.URL + "/",
+		Type:           "image",
+	}
+	client.ResourceBase = client.Endpoint + "v2/"
+	return &glanceRegistry{client: client, pollInterval: time.Millisecond}
+}
+
+func TestGlanceImportImage(t *testing.T) {
+	const url = "https://example.com/ubuntu-2204-kube-v1.27"
+
+	tests := []struct {
+		name           string
+		importStatuses []string
+		failedStores   string
+		wantErr        error
+	}{
+		{name: "active", importStatuses: []string{"queued", "importing", "active"}},
+		{name: "killed", importStatuses: []string{"importing", "killed"}, wantErr: errImageImportFailed},
+		{name: "failed import", importStatuses: []string{"queued"}, failedStores: "file", wantErr: errImageImportFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeGlance{importStatuses: tt.importStatuses, failedStores: tt.failedStores}
+			registry := newTestGlanceRegistry(t, fake)
+
+			createOpts := &CreateOpts{Name: "ubuntu-2204-kube-v1.27", DiskFormat: "qcow2", ContainerFormat: "bare"}
+			imageID, err := registry.ImportImage(context.Background(), createOpts, url)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				if len(fake.deleted) != 1 || len(fake.images) != 0 {
+					t.Errorf("deleted images %v, want the failed image to be deleted", fake.deleted)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("import failed: %v", err)
+			}
+			if imageID != "image-1" {
+				t.Errorf("image ID is %q, want %q", imageID, "image-1")
+			}
+			if fake.importedURL != url {
+				t.Errorf("imported URL is %q, want %q", fake.importedURL, url)
+			}
+			if len(fake.deleted) != 0 {
+				t.Errorf("deleted images %v after successful import", fake.deleted)
+			}
+		})
+	}
+}
+
+func TestGlanceWaitForImageCanceled(t *testing.T) {
+	fake := &fakeGlance{importStatuses: []string{"importing"}}
+	registry := newTestGlanceRegistry(t, fake)
+	fake.images["image-1"] = map[string]interface{}{"id": "image-1", "name": "image", "status": "importing"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := registry.waitForImage(ctx, "image-1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestGlanceStat(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		wantID   string
+		wantErr  error
+	}{
+		{name: "active", statuses: []string{"active"}, wantID: "image-1"},
+		{name: "newest active", statuses: []string{"active", "active"}, wantID: "image-2"},
+		{name: "interrupted upload", statuses: []string{"active", "queued"}, wantID: "image-1"},
+		{name: "only killed", statuses: []string{"killed"}, wantErr: ErrObjectNotFound},
+		{name: "not found", wantErr: ErrObjectNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeGlance{}
+			registry := newTestGlanceRegistry(t, fake)
+			for i, status := range tt.statuses {
+				id := fmt.Sprintf("image-%d", i+1)
+				fake.images[id] = map[string]interface{}{"id": id, "name": "ubuntu", "status": status}
+			}
+
+			objectInfo, err := registry.Stat(context.Background(), "ubuntu")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("stat failed: %v", err)
+			}
+			if objectInfo.ID != tt.wantID {
+				t.Errorf("image ID is %q, want %q", objectInfo.ID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestGlanceUpdateImageProperties(t *testing.T) {
+	fake := &fakeGlance{}
+	registry := newTestGlanceRegistry(t, fake)
+
+	const imageID = "image-1"
+	fake.images[imageID] = map[string]interface{}{"id": imageID, "name": "ubuntu", "status": "active", MetadataInputHash: "abc", "os_distro": "ubuntu"}
+
+	if err := registry.UpdateImageProperties(context.Background(), imageID, map[string]string{MetadataInputHash: "def", MetadataMinDisk: "20"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	image := fake.images[imageID]
+	for key, want := range map[string]string{MetadataInputHash: "def", MetadataMinDisk: "20", "os_distro": "ubuntu"} {
+		if got := image[key]; got != want {
+			t.Errorf("property %s is %v, want %q", key, got, want)
+		}
+	}
+
+	if err := registry.UpdateImageProperties(context.Background(), "missing", map[string]string{MetadataInputHash: "def"}); err == nil {
+		t.Error("expected error updating properties of missing image")
+	}
+}
+
+func TestGlanceRequestCanceledWithContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{HTTPClient: *server.Client(), Context: context.Background()},
+		Endpoint:       server.URL + "/",
+		Type:           "image",
+	}
+	client.ResourceBase = client.Endpoint + "v2/"
+	registry := &glanceRegistry{client: client, pollInterval: time.Millisecond}
+
+	// the request is canceled with the context of the call, not only with the context of the client
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := registry.Stat(ctx, "ubuntu"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("canceled request returned after %s", elapsed)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// MetadataInputHash is the metadata key of the input hash stored with built node images in the registry.
+	MetadataInputHash = "csctl-input-hash"
+	// MetadataMinDisk is the metadata key of the min_disk of built node images.
+	MetadataMinDisk = "csctl-min-disk"
+	// MetadataImageSize is the metadata key of the image_size of built node images.
+	MetadataImageSize = "csctl-image-size"
+	// MetadataSHA256 is the metadata key of the sha256 checksum stored with built and mirrored node images.
+	MetadataSHA256 = "csctl-sha256"
+	// MetadataOSHashAlgo is the metadata key of the os_hash_algo of built node images.
+	MetadataOSHashAlgo = "csctl-os-hash-algo"
+	// MetadataOSHashValue is the metadata key of the os_hash_value of built node images.
+	MetadataOSHashValue = "csctl-os-hash-value"
+
+	// packerVarEnvPrefix is the prefix of environment variables which set packer variables.
+	packerVarEnvPrefix = "PKR_VAR_"
+)
+
+// InputHash returns a hash of the inputs of a packer build: the content of all files in the image directory,
+// including scripts and the http directory, the given build variables and the PKR_VAR_* environment variables.
+// If the hash of two builds is equal, they produce the same node image.
+func InputHash(imageDir string, buildVars []string) (string, error) {
+	hash := sha256.New()
+
+	err := filepath.WalkDir(imageDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(imageDir, filePath)
+		if err != nil {
+			return fmt.Errorf("error getting relative path: %w", err)
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case entry.IsDir():
+			return nil
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return fmt.Errorf("error reading symlink %s: %w", filePath, err)
+			}
+			fmt.Fprintf(hash, "symlink %s %s\n", rel, target)
+			return nil
+		case !entry.Type().IsRegular():
+			return nil
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("error getting file info: %w", err)
+		}
+		// only the executable bit is included, as packer provisioners may depend on executable scripts, while the other
+		// permissions depend on the umask of the checkout
+		fmt.Fprintf(hash, "file %s %t %d\n", rel, fileInfo.Mode().Perm()&0o111 != 0, fileInfo.Size())
+		return hashFile(hash, filePath)
+	})
+	if err != nil {
+		return "", fmt.Errorf("error hashing image directory %s: %w", imageDir, err)
+	}
+
+	vars := append([]string{}, buildVars...)
+	sort.Strings(vars)
+	for _, v := range vars {
+		fmt.Fprintf(hash, "var %s\n", v)
+	}
+
+	var envVars []string
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, packerVarEnvPrefix) {
+			envVars = append(envVars, env)
+		}
+	}
+	sort.Strings(envVars)
+	for _, env := range envVars {
+		fmt.Fprintf(hash, "env %s\n", env)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashFile(w io.Writer, filePath string) error {
+	file, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(w, file); err != nil {
+		return fmt.Errorf("error reading file %s: %w", filePath, err)
+	}
+	return nil
+}
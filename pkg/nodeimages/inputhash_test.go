@@ -0,0 +1,230 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestImageDir writes a packer image directory with a template, a script and an http directory.
+func writeTestImageDir(t *testing.T) string {
+	t.Helper()
+	imageDir := t.TempDir()
+	files := map[string]string{
+		"ubuntu.pkr.hcl":      `source "qemu" "ubuntu" {}`,
+		"scripts/install.sh":  "#!/bin/sh\napt-get install -y kubeadm\n",
+		"http/user-data.yaml": "#cloud-config\n",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(imageDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return imageDir
+}
+
+func TestInputHash(t *testing.T) {
+	buildVars := []string{"build_name=ubuntu", "kubernetes_version=v1.30.2"}
+
+	tests := []struct {
+		name       string
+		change     func(t *testing.T, imageDir string) []string
+		wantChange bool
+	}{
+		{
+			name:   "unchanged",
+			change: func(*testing.T, string) []string { return buildVars },
+		},
+		{
+			name:   "variables in other order",
+			change: func(*testing.T, string) []string { return []string{buildVars[1], buildVars[0]} },
+		},
+		{
+			name: "script changed",
+			change: func(t *testing.T, imageDir string) []string {
+				writeFile(t, filepath.Join(imageDir, "scripts", "install.sh"), "#!/bin/sh\napt-get install -y kubelet\n", 0o644)
+				return buildVars
+			},
+			wantChange: true,
+		},
+		{
+			name: "file in http directory added",
+			change: func(t *testing.T, imageDir string) []string {
+				writeFile(t, filepath.Join(imageDir, "http", "meta-data"), "", 0o644)
+				return buildVars
+			},
+			wantChange: true,
+		},
+		{
+			name: "script made executable",
+			change: func(t *testing.T, imageDir string) []string {
+				if err := os.Chmod(filepath.Join(imageDir, "scripts", "install.sh"), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				return buildVars
+			},
+			wantChange: true,
+		},
+		{
+			name: "script group writable",
+			change: func(t *testing.T, imageDir string) []string {
+				if err := os.Chmod(filepath.Join(imageDir, "scripts", "install.sh"), 0o664); err != nil {
+					t.Fatal(err)
+				}
+				return buildVars
+			},
+		},
+		{
+			name: "script read-only",
+			change: func(t *testing.T, imageDir string) []string {
+				if err := os.Chmod(filepath.Join(imageDir, "scripts", "install.sh"), 0o444); err != nil {
+					t.Fatal(err)
+				}
+				return buildVars
+			},
+		},
+		{
+			name:       "variable changed",
+			change:     func(*testing.T, string) []string { return []string{"build_name=ubuntu", "kubernetes_version=v1.30.3"} },
+			wantChange: true,
+		},
+		{
+			name: "packer environment variable set",
+			change: func(t *testing.T, _ string) []string {
+				t.Setenv("PKR_VAR_kubernetes_version", "v1.30.3")
+				return buildVars
+			},
+			wantChange: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imageDir := writeTestImageDir(t)
+			before, err := InputHash(imageDir, buildVars)
+			if err != nil {
+				t.Fatalf("hashing failed: %v", err)
+			}
+
+			after, err := InputHash(imageDir, tt.change(t, imageDir))
+			if err != nil {
+				t.Fatalf("hashing failed: %v", err)
+			}
+			if changed := before != after; changed != tt.wantChange {
+				t.Errorf("input hash changed is %t, want %t", changed, tt.wantChange)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, filePath, content string, perm os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(filePath, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReuseBuiltImage(t *testing.T) {
+	const nodeImages = `apiVersion: v1
+openStackNodeImages:
+  - url: ""
+    imageDir: ubuntu
+    createOpts:
+      name: ubuntu
+      disk_format: qcow2
+      container_format: bare
+`
+
+	tests := []struct {
+		name            string
+		storedHash      func(inputHash string) string
+		outputDirectory string
+		forceBuild      bool
+		wantReused      bool
+	}{
+		{name: "same inputs", storedHash: func(inputHash string) string { return inputHash }, wantReused: true},
+		{name: "other output directory", storedHash: func(inputHash string) string { return inputHash }, outputDirectory: "/tmp/other", wantReused: true},
+		{name: "changed inputs", storedHash: func(string) string { return strings.Repeat("0", 64) }},
+		{name: "force build", storedHash: func(inputHash string) string { return inputHash }, forceBuild: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusterStackPath := t.TempDir()
+			imageDir := writeTestImageDir(t)
+			if err := os.MkdirAll(filepath.Join(clusterStackPath, "node-images"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(imageDir, filepath.Join(clusterStackPath, "node-images", "ubuntu")); err != nil {
+				t.Fatal(err)
+			}
+			releaseDir := t.TempDir()
+			writeFile(t, filepath.Join(releaseDir, "node-images.yaml"), nodeImages, 0o644)
+
+			registryConfig := &RegistryConfig{Type: RegistryTypeLocal}
+			registryConfig.Config.Directory = t.TempDir()
+			registryConfig.Config.BaseURL = "https://images.example.com"
+			registry := &localRegistry{config: registryConfig}
+
+			image := &OpenStackNodeImage{ImageDir: "ubuntu", CreateOpts: &CreateOpts{Name: "ubuntu", DiskFormat: DiskFormatQCOW2}}
+			inputHash, err := InputHash(filepath.Join(clusterStackPath, "node-images", "ubuntu"), inputVars(image))
+			if err != nil {
+				t.Fatal(err)
+			}
+			metadata := map[string]string{MetadataInputHash: tt.storedHash(inputHash), MetadataMinDisk: "20"}
+			if err := registry.UploadWithMetadata(context.Background(), "ubuntu", strings.NewReader(testImageContent), int64(len(testImageContent)), metadata); err != nil {
+				t.Fatal(err)
+			}
+
+			o := NewOrchestrator(Options{
+				ClusterStackPath: clusterStackPath,
+				ReleaseDir:       releaseDir,
+				OutputDirectory:  tt.outputDirectory,
+				ForceBuild:       tt.forceBuild,
+				Out:              &bytes.Buffer{},
+			})
+			gotHash, reused, err := o.reuseBuiltImage(context.Background(), registry, image, 0)
+			if err != nil {
+				t.Fatalf("reuse failed: %v", err)
+			}
+			if gotHash != inputHash {
+				t.Errorf("input hash is %s, want %s", gotHash, inputHash)
+			}
+			if reused != tt.wantReused {
+				t.Fatalf("reused is %t, want %t", reused, tt.wantReused)
+			}
+			if !reused {
+				return
+			}
+
+			recorded, err := GetConfig(o.NodeImagesPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			recordedImage := recorded.OpenStackNodeImages[0]
+			if recordedImage.URL != "https://images.example.com/ubuntu" || recordedImage.CreateOpts.MinDisk != 20 {
+				t.Errorf("recorded URL %q and min_disk %d, want the reused image", recordedImage.URL, recordedImage.CreateOpts.MinDisk)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// localRegistry is a Registry which stores node images in a local directory tree, e.g. served by a static
+// HTTP server in air-gapped environments. Objects are stored in <directory>/<bucket>/<object>.
+type localRegistry struct {
+	config *RegistryConfig
+}
+
+var _ MetadataRegistry = &localRegistry{}
+
+func newLocalRegistry(_ context.Context, registryConfig *RegistryConfig) (Registry, error) {
+	switch {
+	case registryConfig.Config.Directory == "":
+		return nil, fmt.Errorf("field 'directory' must be defined when registry type is %s", RegistryTypeLocal)
+	case registryConfig.Config.BaseURL == "":
+		return nil, fmt.Errorf("field 'baseURL' must be defined when registry type is %s", RegistryTypeLocal)
+	}
+	return &localRegistry{config: registryConfig}, nil
+}
+
+// bucketDir returns the directory which mirrors the bucket.
+func (r *localRegistry) bucketDir() string {
+	return filepath.Join(r.config.Config.Directory, filepath.FromSlash(r.config.Config.Bucket))
+}
+
+// objectPath returns the path of the object and ensures that it is located in the bucket directory.
+func (r *localRegistry) objectPath(objectName string) (string, error) {
+	objectPath := filepath.Join(r.bucketDir(), filepath.FromSlash(objectName))
+	rel, err := filepath.Rel(r.bucketDir(), objectPath)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("invalid object name %q", objectName)
+	}
+	return objectPath, nil
+}
+
+// Upload copies the content of reader to a temporary file which is renamed afterwards,
+// so a partially written object is never served.
+func (r *localRegistry) Upload(ctx context.Context, objectName string, reader io.Reader, size int64) error {
+	return r.UploadWithMetadata(ctx, objectName, reader, size, nil)
+}
+
+// UploadWithMetadata uploads the object and stores the metadata in the hidden file .<object>.metadata.json
+// next to it, which is not served as object.
+func (r *localRegistry) UploadWithMetadata(ctx context.Context, objectName string, reader io.Reader, size int64, metadata map[string]string) error {
+	objectPath, err := r.objectPath(objectName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(objectPath), os.FileMode(0o755)); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(objectPath), "."+filepath.Base(objectPath)+".*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	written, err := io.Copy(tmpFile, &contextReader{ctx: ctx, reader: reader})
+	if err != nil {
+		return fmt.Errorf("error writing object %s: %w", objectName, err)
+	}
+	if written != size {
+		return fmt.Errorf("error writing object %s: expected %d bytes, got %d", objectName, size, written)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("error writing object %s: %w", objectName, err)
+	}
+	if err := os.Chmod(tmpFile.Name(), os.FileMode(0o644)); err != nil {
+		return fmt.Errorf("error setting permissions of object %s: %w", objectName, err)
+	}
+	// The metadata is written first, so the object is never served without it
+	if err := writeMetadata(objectName, objectPath, metadata); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), objectPath); err != nil {
+		// The metadata does not describe the previous object
+		_ = os.Remove(metadataPath(objectPath))
+		return fmt.Errorf("error writing object %s: %w", objectName, err)
+	}
+	return nil
+}
+
+// UpdateMetadata replaces the metadata of the object in its hidden metadata file.
+func (r *localRegistry) UpdateMetadata(_ context.Context, objectName string, metadata map[string]string) error {
+	objectPath, err := r.objectPath(objectName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(objectPath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%s: %w", objectName, ErrObjectNotFound)
+		}
+		return fmt.Errorf("error getting object info of %s: %w", objectName, err)
+	}
+	return writeMetadata(objectName, objectPath, metadata)
+}
+
+// writeMetadata replaces the metadata file of the object, or removes it if there is no metadata.
+func writeMetadata(objectName, objectPath string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		if err := os.Remove(metadataPath(objectPath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("error removing metadata of object %s: %w", objectName, err)
+		}
+		return nil
+	}
+	metadataData, err := json.Marshal(lowerCaseKeys(metadata))
+	if err != nil {
+		return fmt.Errorf("error marshaling metadata of object %s: %w", objectName, err)
+	}
+	if err := writeFileAtomic(metadataPath(objectPath), metadataData); err != nil {
+		return fmt.Errorf("error writing metadata of object %s: %w", objectName, err)
+	}
+	return nil
+}
+
+// metadataPath returns the path of the file containing the metadata of the object.
+func metadataPath(objectPath string) string {
+	return filepath.Join(filepath.Dir(objectPath), "."+filepath.Base(objectPath)+".metadata.json")
+}
+
+func (r *localRegistry) Stat(_ context.Context, objectName string) (*ObjectInfo, error) {
+	objectPath, err := r.objectPath(objectName)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(objectPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", objectName, ErrObjectNotFound)
+		}
+		return nil, fmt.Errorf("error getting object info of %s: %w", objectName, err)
+	}
+	objectInfo := &ObjectInfo{
+		Name:         objectName,
+		Size:         fileInfo.Size(),
+		LastModified: fileInfo.ModTime(),
+	}
+
+	// #nosec G304
+	metadataData, err := os.ReadFile(metadataPath(objectPath))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(metadataData, &objectInfo.Metadata); err != nil {
+			return nil, fmt.Errorf("error unmarshaling metadata of object %s: %w", objectName, err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("error reading metadata of object %s: %w", objectName, err)
+	}
+	return objectInfo, nil
+}
+
+func (r *localRegistry) Delete(_ context.Context, objectName string) error {
+	objectPath, err := r.objectPath(objectName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(objectPath); err != nil {
+		return fmt.Errorf("error deleting object %s: %w", objectName, err)
+	}
+	if err := os.Remove(metadataPath(objectPath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error deleting metadata of object %s: %w", objectName, err)
+	}
+	return nil
+}
+
+func (r *localRegistry) List(_ context.Context) ([]ObjectInfo, error) {
+	var objectInfos []ObjectInfo
+	err := filepath.WalkDir(r.bucketDir(), func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip directories and temporary files of running uploads
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("error getting file info: %w", err)
+		}
+		rel, err := filepath.Rel(r.bucketDir(), filePath)
+		if err != nil {
+			return fmt.Errorf("error getting object name: %w", err)
+		}
+		objectInfos = append(objectInfos, ObjectInfo{
+			Name:         filepath.ToSlash(rel),
+			Size:         fileInfo.Size(),
+			LastModified: fileInfo.ModTime(),
+		})
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error listing objects: %w", err)
+	}
+	return objectInfos, nil
+}
+
+// URL returns the object URL in the form of <baseURL>/<bucket>/<object>.
+func (r *localRegistry) URL(_ context.Context, objectName string) (string, error) {
+	return strings.TrimSuffix(r.config.Config.BaseURL, "/") + "/" + path.Join(r.config.Config.Bucket, objectName), nil
+}
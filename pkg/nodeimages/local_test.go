@@ -0,0 +1,200 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestLocalRegistry(t *testing.T, bucket, baseURL string) *localRegistry {
+	t.Helper()
+	registryConfig := &RegistryConfig{Type: RegistryTypeLocal}
+	registryConfig.Config.Directory = t.TempDir()
+	registryConfig.Config.Bucket = bucket
+	registryConfig.Config.BaseURL = baseURL
+	return &localRegistry{config: registryConfig}
+}
+
+func TestLocalObjectPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		objectName string
+		wantPath   string
+		wantErr    bool
+	}{
+		{name: "object", objectName: "ubuntu-2204", wantPath: "images/ubuntu-2204"},
+		{name: "nested object", objectName: "ubuntu/v1.30.2", wantPath: "images/ubuntu/v1.30.2"},
+		{name: "cleaned path", objectName: "ubuntu/../debian", wantPath: "images/debian"},
+		{name: "absolute path", objectName: "/ubuntu", wantPath: "images/ubuntu"},
+		{name: "parent directory", objectName: "../ubuntu", wantErr: true},
+		{name: "nested parent directory", objectName: "ubuntu/../../ubuntu", wantErr: true},
+		{name: "bucket directory", objectName: ".", wantErr: true},
+		{name: "empty", objectName: "", wantErr: true},
+	}
+
+	registry := newTestLocalRegistry(t, "images", "https://images.example.com")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objectPath, err := registry.objectPath(tt.objectName)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got path %s", objectPath)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := filepath.Join(registry.config.Config.Directory, filepath.FromSlash(tt.wantPath)); objectPath != want {
+				t.Errorf("path is %s, want %s", objectPath, want)
+			}
+		})
+	}
+}
+
+func TestLocalUploadAndStat(t *testing.T) {
+	registry := newTestLocalRegistry(t, "images", "https://images.example.com")
+	ctx := context.Background()
+
+	metadata := map[string]string{"Csctl-Input-Hash": "abc", MetadataSHA256: "def"}
+	if err := registry.UploadWithMetadata(ctx, "ubuntu/v1.30.2", strings.NewReader(testImageContent), int64(len(testImageContent)), metadata); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	objectInfo, err := registry.Stat(ctx, "ubuntu/v1.30.2")
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if objectInfo.Size != int64(len(testImageContent)) {
+		t.Errorf("size is %d, want %d", objectInfo.Size, len(testImageContent))
+	}
+	for key, want := range map[string]string{MetadataInputHash: "abc", MetadataSHA256: "def"} {
+		if got := objectInfo.Metadata[key]; got != want {
+			t.Errorf("metadata %s is %q, want %q", key, got, want)
+		}
+	}
+
+	if err := registry.UpdateMetadata(ctx, "ubuntu/v1.30.2", map[string]string{MetadataInputHash: "ghi"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	objectInfo, err = registry.Stat(ctx, "ubuntu/v1.30.2")
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if len(objectInfo.Metadata) != 1 || objectInfo.Metadata[MetadataInputHash] != "ghi" {
+		t.Errorf("metadata is %v, want only %s", objectInfo.Metadata, MetadataInputHash)
+	}
+
+	// uploading without metadata removes the metadata of the previous object
+	if err := registry.Upload(ctx, "ubuntu/v1.30.2", strings.NewReader(testImageContent), int64(len(testImageContent))); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	objectInfo, err = registry.Stat(ctx, "ubuntu/v1.30.2")
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if objectInfo.Metadata != nil {
+		t.Errorf("metadata is %v, want none", objectInfo.Metadata)
+	}
+}
+
+func TestLocalUploadShortWrite(t *testing.T) {
+	registry := newTestLocalRegistry(t, "images", "https://images.example.com")
+	ctx := context.Background()
+	if err := registry.Upload(ctx, "ubuntu", strings.NewReader("previous node image"), int64(len("previous node image"))); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := map[string]string{MetadataInputHash: "abc"}
+	err := registry.UploadWithMetadata(ctx, "ubuntu", strings.NewReader(testImageContent), int64(len(testImageContent))+1, metadata)
+	if err == nil {
+		t.Fatal("expected error for short write")
+	}
+
+	entries, err := os.ReadDir(registry.bucketDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !slices.Equal(names, []string{"ubuntu"}) {
+		t.Errorf("bucket contains %v, want only the previous object", names)
+	}
+	data, err := os.ReadFile(filepath.Join(registry.bucketDir(), "ubuntu"))
+	if err != nil || string(data) != "previous node image" {
+		t.Errorf("object is %q (%v), want the previous object", data, err)
+	}
+}
+
+func TestLocalList(t *testing.T) {
+	registry := newTestLocalRegistry(t, "images", "https://images.example.com")
+	ctx := context.Background()
+
+	objects, err := registry.List(ctx)
+	if err != nil || len(objects) != 0 {
+		t.Fatalf("list of missing bucket returned %v (%v), want no objects", objects, err)
+	}
+
+	for _, objectName := range []string{"ubuntu-2204", "ubuntu/v1.30.2"} {
+		if err := registry.UploadWithMetadata(ctx, objectName, strings.NewReader(testImageContent), int64(len(testImageContent)), map[string]string{MetadataInputHash: "abc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// temporary file of a running upload
+	writeFile(t, filepath.Join(registry.bucketDir(), ".debian-12.123456"), "partial", 0o600)
+
+	objects, err = registry.List(ctx)
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	var names []string
+	for _, objectInfo := range objects {
+		names = append(names, objectInfo.Name)
+	}
+	if want := []string{"ubuntu/v1.30.2", "ubuntu-2204"}; !slices.Equal(names, want) {
+		t.Errorf("objects are %v, want %v", names, want)
+	}
+}
+
+func TestLocalURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		bucket  string
+		baseURL string
+		want    string
+	}{
+		{name: "bucket", bucket: "images", baseURL: "https://images.example.com", want: "https://images.example.com/images/ubuntu"},
+		{name: "trailing slash", bucket: "images", baseURL: "https://images.example.com/", want: "https://images.example.com/images/ubuntu"},
+		{name: "base path", bucket: "images", baseURL: "https://example.com/node-images", want: "https://example.com/node-images/images/ubuntu"},
+		{name: "nested bucket", bucket: "node-images/openstack/", baseURL: "https://images.example.com", want: "https://images.example.com/node-images/openstack/ubuntu"},
+		{name: "no bucket", baseURL: "https://images.example.com", want: "https://images.example.com/ubuntu"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newTestLocalRegistry(t, tt.bucket, tt.baseURL)
+			got, err := registry.URL(context.Background(), "ubuntu")
+			if err != nil || got != tt.want {
+				t.Errorf("URL is %q (%v), want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+//go:build linux || darwin
+
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockDir takes an exclusive advisory lock on the directory, so concurrent runs do not modify the same files.
+// It fails with ErrLocked if another run holds the lock. The lock is released by the returned function or when
+// the process exits.
+func lockDir(dir string) (func(), error) {
+	// #nosec G304
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", dir, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s is used by another run of csctl-openstack", ErrLocked, dir)
+		}
+		return nil, fmt.Errorf("error locking %s: %w", dir, err)
+	}
+	return func() { file.Close() }, nil
+}
@@ -0,0 +1,48 @@
+//go:build linux || darwin
+
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockDir(t *testing.T) {
+	dir := t.TempDir()
+
+	unlock, err := lockDir(dir)
+	if err != nil {
+		t.Fatalf("locking failed: %v", err)
+	}
+	// flock locks belong to the open file, so a second lock of the same process conflicts like another run
+	if _, err := lockDir(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second lock returned %v, want %v", err, ErrLocked)
+	}
+
+	unlock()
+	unlock, err = lockDir(dir)
+	if err != nil {
+		t.Fatalf("locking after unlock failed: %v", err)
+	}
+	unlock()
+}
+
+func TestLockDirMissing(t *testing.T) {
+	if _, err := lockDir(filepath.Join(t.TempDir(), "missing")); err == nil || errors.Is(err, ErrLocked) {
+		t.Fatalf("locking missing directory returned %v, want an error other than %v", err, ErrLocked)
+	}
+}
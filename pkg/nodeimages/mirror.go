@@ -0,0 +1,145 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Mirror downloads every node image from its URL, uploads it to the registry and replaces the URL, or sets the
+// image ID if the registry is an ImageRegistry, of the node image in config. The config.yaml file is not changed.
+// The sha256 checksum is stored as metadata with every mirrored node image. Node images which already exist with the
+// same checksum in the registry are not uploaded again.
+func (o *Orchestrator) Mirror(ctx context.Context, registry Registry, config *NodeImages) error {
+	names := make(map[string]bool, len(config.OpenStackNodeImages))
+	for _, image := range config.OpenStackNodeImages {
+		if image.URL == "" {
+			return fmt.Errorf("%w: field 'url' of image %s must be defined when using the %s method", ErrConfigInvalid, image.CreateOpts.Name, MethodMirror)
+		}
+		if err := checkMirrorName(image.CreateOpts.Name, names); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigInvalid, err)
+		}
+	}
+
+	for _, image := range config.OpenStackNodeImages {
+		if err := o.mirrorImage(ctx, registry, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMirrorName checks that the name of a node image can be used as object name by the mirror method: it must not
+// contain '/' and must not be used by another node image. names contains the names checked before and is updated.
+func checkMirrorName(name string, names map[string]bool) error {
+	switch {
+	case strings.Contains(name, "/"):
+		return fmt.Errorf("field 'name' %q in CreateOpts must not contain '/' when using the %s method", name, MethodMirror)
+	case names[name]:
+		return fmt.Errorf("duplicate node image name %q, the %s method stores node images by name", name, MethodMirror)
+	}
+	names[name] = true
+	return nil
+}
+
+func (o *Orchestrator) mirrorImage(ctx context.Context, registry Registry, image *OpenStackNodeImage) error {
+	fmt.Fprintf(o.imageOut(image), "Downloading image %s from %s...\n", image.CreateOpts.Name, image.URL)
+	imagePath, checksum, cleanup, err := o.download(ctx, image)
+	if err != nil {
+		return fmt.Errorf("%w: error downloading image %s: %w", ErrURLVerificationFailed, image.CreateOpts.Name, err)
+	}
+	defer cleanup()
+
+	if _, err := o.checkDiskFormat(image, imagePath); err != nil {
+		return err
+	}
+
+	if imageRegistry, ok := registry.(ImageRegistry); ok {
+		existing, err := statImage(ctx, imageRegistry, image.CreateOpts.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil && identicalImage(existing, checksum) {
+			fmt.Fprintf(o.imageOut(image), "Image %s already exists in Glance as image %s, skipping upload\n", image.CreateOpts.Name, existing.ID)
+			image.ImageID = existing.ID
+			image.Checksum = checksum
+			return nil
+		}
+
+		fmt.Fprintf(o.imageOut(image), "Uploading image %s to Glance...\n", image.CreateOpts.Name)
+		imageID, _, err := UploadImageFile(ctx, imageRegistry, imagePath, image.CreateOpts)
+		if err != nil {
+			return fmt.Errorf("%w: error uploading image to Glance: %w", ErrUploadFailed, err)
+		}
+		image.ImageID = imageID
+		image.Checksum = checksum
+		return nil
+	}
+
+	objectName := image.CreateOpts.Name
+	objectInfo, err := registry.Stat(ctx, objectName)
+	switch {
+	case err == nil && objectInfo.Metadata[MetadataSHA256] == checksum.SHA256:
+		fmt.Fprintf(o.imageOut(image), "Image %s already exists in the registry, skipping upload\n", image.CreateOpts.Name)
+	case err == nil || errors.Is(err, ErrObjectNotFound):
+		fmt.Fprintf(o.imageOut(image), "Uploading image %s to the registry...\n", image.CreateOpts.Name)
+		metadata := map[string]string{MetadataSHA256: checksum.SHA256}
+		if _, err := UploadFileWithMetadata(ctx, registry, imagePath, objectName, metadata); err != nil {
+			return fmt.Errorf("%w: error pushing image to registry: %w", ErrUploadFailed, err)
+		}
+	default:
+		return fmt.Errorf("%w: error getting image %s from registry: %w", ErrUploadFailed, image.CreateOpts.Name, err)
+	}
+
+	url, err := registry.URL(ctx, objectName)
+	if err != nil {
+		return fmt.Errorf("%w: error getting URL of image %s: %w", ErrUploadFailed, image.CreateOpts.Name, err)
+	}
+	fmt.Fprintf(o.imageOut(image), "Image %s mirrored from %s to %s\n", image.CreateOpts.Name, image.URL, url)
+	image.URL = url
+	image.Checksum = checksum
+	if o.opts.Cache != nil {
+		if _, _, err := o.opts.Cache.Add(url, imagePath, checksum); err != nil {
+			fmt.Fprintf(o.imageOut(image), "Warning: error adding image %s to cache: %v\n", image.CreateOpts.Name, err)
+		}
+	}
+	return nil
+}
+
+// download downloads the node image from its URL, into the cache if it is enabled, and verifies its checksum
+// if defined. It returns the path to the downloaded file, its checksums and a function which removes temporary files.
+func (o *Orchestrator) download(ctx context.Context, image *OpenStackNodeImage) (string, *Checksum, func(), error) {
+	if o.opts.Cache != nil {
+		imagePath, checksum, err := o.opts.Cache.Download(ctx, o.opts.HTTPClient, image.URL, image.Checksum)
+		return imagePath, checksum, func() {}, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "csctl-openstack-mirror-")
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("error creating temporary directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	// a cache in the temporary directory downloads and verifies the image in the same way
+	imagePath, checksum, err := NewCache(tmpDir, 0).Download(ctx, o.opts.HTTPClient, image.URL, image.Checksum)
+	if err != nil {
+		cleanup()
+		return "", nil, nil, err
+	}
+	return imagePath, checksum, cleanup, nil
+}
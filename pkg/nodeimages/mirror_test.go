@@ -0,0 +1,184 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	content := testImageContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(content))
+	}))
+	t.Cleanup(server.Close)
+
+	registryConfig := &RegistryConfig{Type: RegistryTypeLocal}
+	registryConfig.Config.Directory = t.TempDir()
+	registryConfig.Config.Bucket = "mirror"
+	registryConfig.Config.BaseURL = "https://images.example.com"
+	registry := &localRegistry{config: registryConfig}
+	cache := NewCache(t.TempDir(), 0)
+
+	// the steps run one after another against the same registry and cache
+	tests := []struct {
+		name         string
+		content      string
+		checksum     *Checksum
+		wantUploaded bool
+		wantErr      error
+	}{
+		{name: "upload", content: testImageContent, wantUploaded: true},
+		{name: "unchanged", content: testImageContent},
+		{name: "changed upstream", content: "rebuilt node image", wantUploaded: true},
+		{name: "checksum mismatch", content: testImageContent, checksum: &Checksum{SHA256: strings.Repeat("0", 64)}, wantErr: ErrURLVerificationFailed},
+		{name: "disk format mismatch", content: string(qcow2Magic) + testImageContent, wantErr: ErrConfigInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content = tt.content
+			config := &NodeImages{OpenStackNodeImages: []*OpenStackNodeImage{{
+				URL:        server.URL + "/ubuntu.img",
+				Checksum:   tt.checksum,
+				CreateOpts: &CreateOpts{Name: "ubuntu", DiskFormat: DiskFormatRaw, ContainerFormat: "bare"},
+			}}}
+			out := &bytes.Buffer{}
+			o := NewOrchestrator(Options{HTTPClient: server.Client(), Cache: cache, Out: out})
+
+			err := o.Mirror(context.Background(), registry, config)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mirror failed: %v", err)
+			}
+
+			sum := sha256.Sum256([]byte(tt.content))
+			image := config.OpenStackNodeImages[0]
+			if image.URL != "https://images.example.com/mirror/ubuntu" {
+				t.Errorf("URL is %q, want the mirrored location", image.URL)
+			}
+			if image.Checksum == nil || image.Checksum.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("checksum is %+v, want sha256 %x", image.Checksum, sum)
+			}
+			if uploaded := !strings.Contains(out.String(), "skipping upload"); uploaded != tt.wantUploaded {
+				t.Errorf("uploaded is %t, want %t, output:\n%s", uploaded, tt.wantUploaded, out.String())
+			}
+			data, err := os.ReadFile(filepath.Join(registryConfig.Config.Directory, "mirror", "ubuntu"))
+			if err != nil || string(data) != tt.content {
+				t.Errorf("mirrored image is %q (%v), want %q", data, err, tt.content)
+			}
+		})
+	}
+}
+
+func TestMirrorGlance(t *testing.T) {
+	content := testImageContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(content))
+	}))
+	t.Cleanup(server.Close)
+
+	fake := &fakeGlance{}
+	registry := newTestGlanceRegistry(t, fake)
+
+	// the steps run one after another against the same Glance
+	tests := []struct {
+		name        string
+		content     string
+		wantImageID string
+		wantImages  int
+	}{
+		{name: "upload", content: testImageContent, wantImageID: "image-1", wantImages: 1},
+		{name: "unchanged", content: testImageContent, wantImageID: "image-1", wantImages: 1},
+		{name: "changed upstream", content: "rebuilt node image", wantImageID: "image-2", wantImages: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content = tt.content
+			config := &NodeImages{OpenStackNodeImages: []*OpenStackNodeImage{{
+				URL:        server.URL + "/ubuntu.img",
+				CreateOpts: &CreateOpts{Name: "ubuntu", DiskFormat: DiskFormatRaw, ContainerFormat: "bare"},
+			}}}
+			o := NewOrchestrator(Options{HTTPClient: server.Client(), Out: &bytes.Buffer{}})
+
+			if err := o.Mirror(context.Background(), registry, config); err != nil {
+				t.Fatalf("mirror failed: %v", err)
+			}
+			if imageID := config.OpenStackNodeImages[0].ImageID; imageID != tt.wantImageID {
+				t.Errorf("image ID is %q, want %q", imageID, tt.wantImageID)
+			}
+			if len(fake.images) != tt.wantImages {
+				t.Errorf("Glance has %d images, want %d", len(fake.images), tt.wantImages)
+			}
+		})
+	}
+}
+
+func TestMirrorInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		images  []*OpenStackNodeImage
+		wantErr string
+	}{
+		{
+			name:    "missing URL",
+			images:  []*OpenStackNodeImage{{ImageID: "image-1", CreateOpts: &CreateOpts{Name: "ubuntu"}}},
+			wantErr: "field 'url' of image ubuntu must be defined",
+		},
+		{
+			name:    "name with slash",
+			images:  []*OpenStackNodeImage{{URL: "https://example.com/ubuntu.qcow2", CreateOpts: &CreateOpts{Name: "ubuntu/v1.30.2"}}},
+			wantErr: `field 'name' "ubuntu/v1.30.2" in CreateOpts must not contain '/'`,
+		},
+		{
+			name: "duplicate name",
+			images: []*OpenStackNodeImage{
+				{URL: "https://example.com/ubuntu.qcow2", CreateOpts: &CreateOpts{Name: "ubuntu"}},
+				{URL: "https://example.com/ubuntu-2404.qcow2", CreateOpts: &CreateOpts{Name: "ubuntu"}},
+			},
+			wantErr: `duplicate node image name "ubuntu"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			o := NewOrchestrator(Options{Out: out})
+			err := o.Mirror(context.Background(), &localRegistry{config: &RegistryConfig{}}, &NodeImages{OpenStackNodeImages: tt.images})
+			if !errors.Is(err, ErrConfigInvalid) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected %v with %q, got %v", ErrConfigInvalid, tt.wantErr, err)
+			}
+			// Nothing is mirrored if any node image is invalid
+			if out.Len() > 0 {
+				t.Errorf("unexpected output %q", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,566 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ociManifestMediaType       = "application/vnd.oci.image.manifest.v1+json"
+	ociEmptyConfigMediaType    = "application/vnd.oci.empty.v1+json"
+	ociNodeImageArtifactType   = "application/vnd.sovereigncloudstack.node-image.v1"
+	ociNodeImageLayerMediaType = "application/vnd.sovereigncloudstack.node-image.layer.v1"
+
+	ociAnnotationTitle   = "org.opencontainers.image.title"
+	ociAnnotationCreated = "org.opencontainers.image.created"
+	// ociAnnotationMetadataPrefix is the prefix of the manifest annotations containing the object metadata.
+	ociAnnotationMetadataPrefix = "org.sovereigncloudstack.node-image.metadata."
+)
+
+// ociEmptyConfig is the content of the empty config blob recommended for artifacts.
+var ociEmptyConfig = []byte("{}")
+
+// errOCIUnexpectedStatus is returned if the OCI registry responds with an unexpected status code.
+var errOCIUnexpectedStatus = errors.New("unexpected status code")
+
+// ociInvalidTagChars matches all characters which are not allowed in a tag.
+var ociInvalidTagChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// ociDescriptor describes content stored in an OCI registry.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an OCI image manifest.
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociRegistry is a Registry which pushes node images as OCI artifacts to a Distribution compatible registry.
+// The bucket defined in registry.yaml is used as repository and every object is stored under its own tag.
+type ociRegistry struct {
+	client     *http.Client
+	config     *RegistryConfig
+	repository string
+
+	mu            sync.Mutex
+	authorization string
+	layerDigests  map[string]string
+}
+
+var _ MetadataRegistry = &ociRegistry{}
+
+func newOCIRegistry(_ context.Context, registryConfig *RegistryConfig) (Registry, error) {
+	if registryConfig.Config.Bucket == "" {
+		return nil, fmt.Errorf("field 'bucket' must be defined when registry type is %s", RegistryTypeOCI)
+	}
+
+	// TLS configuration
+	config, err := tlsConfig(registryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ociRegistry{
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: config,
+			},
+		},
+		config:       registryConfig,
+		repository:   strings.Trim(registryConfig.Config.Bucket, "/"),
+		layerDigests: make(map[string]string),
+	}, nil
+}
+
+// ociTag converts an object name into a valid tag.
+func ociTag(objectName string) string {
+	tag := ociInvalidTagChars.ReplaceAllString(objectName, "-")
+	const maxTagLength = 128
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+	return tag
+}
+
+func (r *ociRegistry) Upload(ctx context.Context, objectName string, reader io.Reader, size int64) error {
+	return r.UploadWithMetadata(ctx, objectName, reader, size, nil)
+}
+
+// UploadWithMetadata pushes the object and stores the metadata as manifest annotations.
+func (r *ociRegistry) UploadWithMetadata(ctx context.Context, objectName string, reader io.Reader, size int64, metadata map[string]string) error {
+	configDescriptor, err := r.pushBlob(ctx, bytes.NewReader(ociEmptyConfig), int64(len(ociEmptyConfig)))
+	if err != nil {
+		return fmt.Errorf("error pushing config of %s: %w", objectName, err)
+	}
+	configDescriptor.MediaType = ociEmptyConfigMediaType
+
+	layerDescriptor, err := r.pushBlob(ctx, reader, size)
+	if err != nil {
+		return fmt.Errorf("error pushing layer of %s: %w", objectName, err)
+	}
+	layerDescriptor.MediaType = ociNodeImageLayerMediaType
+	layerDescriptor.Annotations = map[string]string{ociAnnotationTitle: objectName}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  ociNodeImageArtifactType,
+		Config:        *configDescriptor,
+		Layers:        []ociDescriptor{*layerDescriptor},
+		Annotations:   map[string]string{ociAnnotationCreated: time.Now().UTC().Format(time.RFC3339)},
+	}
+	setManifestMetadata(&manifest, metadata)
+	if err := r.pushManifest(ctx, objectName, &manifest); err != nil {
+		return err
+	}
+
+	r.setLayerDigest(objectName, layerDescriptor.Digest)
+	return nil
+}
+
+// UpdateMetadata replaces the metadata annotations of the manifest of the object and pushes it under the same tag.
+// The blobs of the object are not uploaded again.
+func (r *ociRegistry) UpdateMetadata(ctx context.Context, objectName string, metadata map[string]string) error {
+	manifest, _, err := r.getManifest(ctx, objectName)
+	if err != nil {
+		return err
+	}
+	setManifestMetadata(manifest, metadata)
+	return r.pushManifest(ctx, objectName, manifest)
+}
+
+// setManifestMetadata replaces the metadata annotations of the manifest.
+func setManifestMetadata(manifest *ociManifest, metadata map[string]string) {
+	for key := range manifest.Annotations {
+		if strings.HasPrefix(key, ociAnnotationMetadataPrefix) {
+			delete(manifest.Annotations, key)
+		}
+	}
+	if manifest.Annotations == nil && len(metadata) > 0 {
+		manifest.Annotations = make(map[string]string, len(metadata))
+	}
+	for key, value := range metadata {
+		manifest.Annotations[ociAnnotationMetadataPrefix+strings.ToLower(key)] = value
+	}
+}
+
+// pushManifest pushes the manifest under the tag of the object.
+func (r *ociRegistry) pushManifest(ctx context.Context, objectName string, manifest *ociManifest) error {
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("error marshaling manifest of %s: %w", objectName, err)
+	}
+
+	header := http.Header{"Content-Type": []string{ociManifestMediaType}}
+	resp, err := r.do(ctx, http.MethodPut, r.repositoryURL("manifests", ociTag(objectName)), manifestData, header)
+	if err != nil {
+		return fmt.Errorf("error pushing manifest of %s: %w", objectName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("error pushing manifest of %s: %w", objectName, ociStatusError(resp))
+	}
+	return nil
+}
+
+// pushBlob streams the content of reader as blob to the repository and returns its descriptor.
+// The digest is calculated while uploading, so the content is only read once.
+func (r *ociRegistry) pushBlob(ctx context.Context, reader io.Reader, size int64) (*ociDescriptor, error) {
+	resp, err := r.do(ctx, http.MethodPost, r.repositoryURL("blobs", "uploads")+"/", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, fmt.Errorf("error starting blob upload: %w", ociStatusError(resp))
+	}
+	location, err := resolveLocation(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, location, io.TeeReader(reader, hash))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	// The body can only be read once, so the request is sent with the current authorization without retry.
+	if authorization := r.getAuthorization(); authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err = r.client.Do(req)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("error uploading blob: %w", err), r.cancelUpload(ctx, location))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+		return nil, errors.Join(fmt.Errorf("error uploading blob: %w", ociStatusError(resp)), r.cancelUpload(ctx, location))
+	}
+	location, err = resolveLocation(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	completeURL, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing upload location: %w", err)
+	}
+	query := completeURL.Query()
+	query.Set("digest", digest)
+	completeURL.RawQuery = query.Encode()
+
+	resp, err = r.do(ctx, http.MethodPut, completeURL.String(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("error completing blob upload: %w", ociStatusError(resp))
+	}
+
+	return &ociDescriptor{Digest: digest, Size: size}, nil
+}
+
+func (r *ociRegistry) Stat(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	manifest, _, err := r.getManifest(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, fmt.Errorf("manifest of %s does not contain a layer", objectName)
+	}
+
+	r.setLayerDigest(objectName, manifest.Layers[0].Digest)
+
+	objectInfo := &ObjectInfo{
+		Name: objectName,
+		Size: manifest.Layers[0].Size,
+	}
+	if created, err := time.Parse(time.RFC3339, manifest.Annotations[ociAnnotationCreated]); err == nil {
+		objectInfo.LastModified = created
+	}
+	for key, value := range manifest.Annotations {
+		if metadataKey, ok := strings.CutPrefix(key, ociAnnotationMetadataPrefix); ok {
+			if objectInfo.Metadata == nil {
+				objectInfo.Metadata = make(map[string]string)
+			}
+			objectInfo.Metadata[metadataKey] = value
+		}
+	}
+	return objectInfo, nil
+}
+
+func (r *ociRegistry) Delete(ctx context.Context, objectName string) error {
+	_, manifestDigest, err := r.getManifest(ctx, objectName)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(ctx, http.MethodDelete, r.repositoryURL("manifests", manifestDigest), nil, nil)
+	if err != nil {
+		return fmt.Errorf("error deleting manifest of %s: %w", objectName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("error deleting manifest of %s: %w", objectName, ociStatusError(resp))
+	}
+	return nil
+}
+
+func (r *ociRegistry) List(ctx context.Context) ([]ObjectInfo, error) {
+	var tags []string
+	next := r.repositoryURL("tags", "list")
+	for next != "" {
+		resp, err := r.do(ctx, http.MethodGet, next, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error listing tags: %w", err)
+		}
+		var tagList struct {
+			Tags []string `json:"tags"`
+		}
+		err = decodeOCIResponse(resp, &tagList)
+		if err != nil {
+			return nil, fmt.Errorf("error listing tags: %w", err)
+		}
+		tags = append(tags, tagList.Tags...)
+
+		next, err = r.nextLink(resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	objectInfos := make([]ObjectInfo, 0, len(tags))
+	for _, tag := range tags {
+		objectInfo, err := r.Stat(ctx, tag)
+		if err != nil {
+			return nil, err
+		}
+		objectInfos = append(objectInfos, *objectInfo)
+	}
+	return objectInfos, nil
+}
+
+// URL returns the download URL of the node image blob in the form of <endpoint>/v2/<repository>/blobs/<digest>.
+// The digest of the blob is resolved from the manifest of the object unless it was uploaded or inspected before.
+func (r *ociRegistry) URL(ctx context.Context, objectName string) (string, error) {
+	r.mu.Lock()
+	digest, ok := r.layerDigests[objectName]
+	r.mu.Unlock()
+	if !ok {
+		if _, err := r.Stat(ctx, objectName); err != nil {
+			return "", fmt.Errorf("error resolving digest of %s: %w", objectName, err)
+		}
+		r.mu.Lock()
+		digest = r.layerDigests[objectName]
+		r.mu.Unlock()
+	}
+	return r.repositoryURL("blobs", digest), nil
+}
+
+func (r *ociRegistry) setLayerDigest(objectName, digest string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.layerDigests[objectName] = digest
+}
+
+// getManifest returns the manifest of the object and its digest.
+func (r *ociRegistry) getManifest(ctx context.Context, objectName string) (*ociManifest, string, error) {
+	header := http.Header{"Accept": []string{ociManifestMediaType}}
+	resp, err := r.do(ctx, http.MethodGet, r.repositoryURL("manifests", ociTag(objectName)), nil, header)
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting manifest of %s: %w", objectName, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("%s: %w", objectName, ErrObjectNotFound)
+	}
+
+	var manifest ociManifest
+	if err := decodeOCIResponse(resp, &manifest); err != nil {
+		return nil, "", fmt.Errorf("error getting manifest of %s: %w", objectName, err)
+	}
+	return &manifest, resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+func (r *ociRegistry) repositoryURL(kind, reference string) string {
+	return fmt.Sprintf("%s/v2/%s/%s/%s", endpointURL(r.config), r.repository, kind, reference)
+}
+
+// resolveLocation returns the absolute URL of the Location header of the response.
+func resolveLocation(resp *http.Response) (string, error) {
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("error getting upload location: %w", err)
+	}
+	return location.String(), nil
+}
+
+// nextLink returns the absolute URL of the next page referenced in the Link header of the response.
+func (r *ociRegistry) nextLink(resp *http.Response) (string, error) {
+	link := resp.Header.Get("Link")
+	if link == "" {
+		return "", nil
+	}
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("error parsing link header %q", link)
+	}
+	base, err := url.Parse(endpointURL(r.config))
+	if err != nil {
+		return "", fmt.Errorf("error parsing endpoint: %w", err)
+	}
+	next, err := base.Parse(link[start+1 : end])
+	if err != nil {
+		return "", fmt.Errorf("error parsing link header %q: %w", link, err)
+	}
+	return next.String(), nil
+}
+
+// cancelUpload cancels the blob upload session at the given location, so the registry can discard the uploaded data.
+// The request is also sent if the context is canceled.
+func (r *ociRegistry) cancelUpload(ctx context.Context, location string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	resp, err := r.do(ctx, http.MethodDelete, location, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error canceling blob upload: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a request with the given body. If the registry requires authentication,
+// the request is authorized and sent again.
+func (r *ociRegistry) do(ctx context.Context, method, requestURL string, body []byte, header http.Header) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, requestURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if authorization := r.getAuthorization(); authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error sending request: %w", err)
+		}
+		return resp, nil
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	if err := r.authorize(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+func (r *ociRegistry) getAuthorization() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.authorization
+}
+
+// authorize sets the authorization based on the challenge of the registry.
+// Basic and bearer token authentication are supported.
+func (r *ociRegistry) authorize(ctx context.Context, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		credentials := r.config.Config.AccessKey + ":" + r.config.Config.SecretKey
+		r.mu.Lock()
+		r.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+		r.mu.Unlock()
+		return nil
+	case "bearer":
+		token, err := r.fetchToken(ctx, parseOCIChallenge(params))
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.authorization = "Bearer " + token
+		r.mu.Unlock()
+		return nil
+	default:
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+}
+
+// fetchToken requests a bearer token with pull and push access to the repository from the token service.
+func (r *ociRegistry) fetchToken(ctx context.Context, challenge map[string]string) (string, error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil || challenge["realm"] == "" {
+		return "", fmt.Errorf("invalid realm %q in authentication challenge", challenge["realm"])
+	}
+	query := realm.Query()
+	if challenge["service"] != "" {
+		query.Set("service", challenge["service"])
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull,push", r.repository))
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), http.NoBody)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	if r.config.Config.AccessKey != "" {
+		req.SetBasicAuth(r.config.Config.AccessKey, r.config.Config.SecretKey)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting token: %w", err)
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"` //nolint:tagliatelle // defined by the token authentication specification
+	}
+	if err := decodeOCIResponse(resp, &tokenResponse); err != nil {
+		return "", fmt.Errorf("error requesting token: %w", err)
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+// parseOCIChallenge parses the parameters of a WWW-Authenticate header like realm="...",service="...".
+func parseOCIChallenge(params string) map[string]string {
+	challenge := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+		challenge[strings.ToLower(key)] = strings.Trim(value, `"`)
+	}
+	return challenge
+}
+
+// decodeOCIResponse decodes the JSON body of a successful response and closes it.
+func decodeOCIResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ociStatusError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+	return nil
+}
+
+func ociStatusError(resp *http.Response) error {
+	const maxErrorBodySize = 1024
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	return fmt.Errorf("%w %d: %s", errOCIUnexpectedStatus, resp.StatusCode, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,357 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeOCIRegistry is a minimal Distribution registry which stores blobs and manifests of a single repository in
+// memory. It requires a bearer token or, if basicAuth is set, basic authentication.
+type fakeOCIRegistry struct {
+	server    *httptest.Server
+	basicAuth bool
+
+	mu              sync.Mutex
+	uploads         map[string][]byte
+	blobs           map[string][]byte
+	manifests       map[string][]byte
+	canceledUploads int
+	failPatch       bool
+	nextUploadID    int
+}
+
+const (
+	fakeOCIUser       = "user"
+	fakeOCIPassword   = "password"
+	fakeOCIToken      = "token"
+	fakeOCIRepository = "node-images"
+)
+
+func newFakeOCIRegistry(t *testing.T, basicAuth bool) *fakeOCIRegistry {
+	t.Helper()
+	fake := &fakeOCIRegistry{
+		basicAuth: basicAuth,
+		uploads:   map[string][]byte{},
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+	}
+	fake.server = httptest.NewServer(fake)
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func (f *fakeOCIRegistry) registry(t *testing.T) *ociRegistry {
+	t.Helper()
+	registryConfig := &RegistryConfig{Type: RegistryTypeOCI}
+	registryConfig.Config.Endpoint = f.server.URL
+	registryConfig.Config.Bucket = fakeOCIRepository
+	registryConfig.Config.AccessKey = fakeOCIUser
+	registryConfig.Config.SecretKey = fakeOCIPassword
+	registry, err := newOCIRegistry(context.Background(), registryConfig)
+	if err != nil {
+		t.Fatalf("error creating OCI registry: %v", err)
+	}
+	return registry.(*ociRegistry)
+}
+
+func (f *fakeOCIRegistry) authorized(req *http.Request) bool {
+	if f.basicAuth {
+		user, password, ok := req.BasicAuth()
+		return ok && user == fakeOCIUser && password == fakeOCIPassword
+	}
+	return req.Header.Get("Authorization") == "Bearer "+fakeOCIToken
+}
+
+func (f *fakeOCIRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		user, password, ok := req.BasicAuth()
+		if !ok || user != fakeOCIUser || password != fakeOCIPassword ||
+			req.URL.Query().Get("scope") != "repository:"+fakeOCIRepository+":pull,push" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": %q}`, fakeOCIToken)
+		return
+	}
+
+	if !f.authorized(req) {
+		if f.basicAuth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, f.server.URL))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path, ok := strings.CutPrefix(req.URL.Path, "/v2/"+fakeOCIRepository+"/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	kind, reference, _ := strings.Cut(path, "/")
+	switch {
+	case kind == "blobs" && reference == "uploads/" && req.Method == http.MethodPost:
+		f.nextUploadID++
+		id := fmt.Sprint(f.nextUploadID)
+		f.uploads[id] = nil
+		// Relative locations have to be resolved by the client
+		w.Header().Set("Location", "/v2/"+fakeOCIRepository+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "blobs" && strings.HasPrefix(reference, "uploads/"):
+		f.serveUpload(w, req, strings.TrimPrefix(reference, "uploads/"))
+	case kind == "blobs" && req.Method == http.MethodGet:
+		blob, ok := f.blobs[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blob)
+	case kind == "manifests":
+		f.serveManifest(w, req, reference)
+	case kind == "tags" && reference == "list" && req.Method == http.MethodGet:
+		f.serveTags(w, req)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeOCIRegistry) serveUpload(w http.ResponseWriter, req *http.Request, id string) {
+	data, ok := f.uploads[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodPatch:
+		if f.failPatch {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		f.uploads[id] = append(data, body...)
+		w.Header().Set("Location", req.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		digest := req.URL.Query().Get("digest")
+		sum := sha256.Sum256(data)
+		if digest != "sha256:"+hex.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(f.uploads, id)
+		f.blobs[digest] = data
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(f.uploads, id)
+		f.canceledUploads++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeOCIRegistry) serveManifest(w http.ResponseWriter, req *http.Request, reference string) {
+	switch req.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		f.manifests[reference] = data
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		data, ok := f.manifests[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sum := sha256.Sum256(data)
+		w.Header().Set("Docker-Content-Digest", "sha256:"+hex.EncodeToString(sum[:]))
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		for tag, data := range f.manifests {
+			sum := sha256.Sum256(data)
+			if "sha256:"+hex.EncodeToString(sum[:]) == reference {
+				delete(f.manifests, tag)
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveTags returns one tag per page, so the client has to follow the Link header.
+func (f *fakeOCIRegistry) serveTags(w http.ResponseWriter, req *http.Request) {
+	tags := make([]string, 0, len(f.manifests))
+	for tag := range f.manifests {
+		if tag > req.URL.Query().Get("last") {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	if len(tags) > 1 {
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?last=%s&n=1>; rel="next"`, fakeOCIRepository, tags[0]))
+		tags = tags[:1]
+	}
+	fmt.Fprintf(w, `{"name": %q, "tags": ["%s"]}`, fakeOCIRepository, strings.Join(tags, `", "`))
+}
+
+func TestOCIUploadAndStat(t *testing.T) {
+	for _, basicAuth := range []bool{false, true} {
+		t.Run(fmt.Sprintf("basicAuth=%t", basicAuth), func(t *testing.T) {
+			fake := newFakeOCIRegistry(t, basicAuth)
+			registry := fake.registry(t)
+
+			content := "node image"
+			metadata := map[string]string{MetadataInputHash: "abc"}
+			if err := registry.UploadWithMetadata(context.Background(), "ubuntu-2204-kube-v1.27", strings.NewReader(content), int64(len(content)), metadata); err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+
+			sum := sha256.Sum256([]byte(content))
+			digest := "sha256:" + hex.EncodeToString(sum[:])
+			if got := string(fake.blobs[digest]); got != content {
+				t.Errorf("blob content is %q, want %q", got, content)
+			}
+			wantURL := fmt.Sprintf("%s/v2/%s/blobs/%s", fake.server.URL, fakeOCIRepository, digest)
+			if got, err := registry.URL(context.Background(), "ubuntu-2204-kube-v1.27"); err != nil || got != wantURL {
+				t.Errorf("URL is %q (%v), want %q", got, err, wantURL)
+			}
+			// another registry resolves the digest from the manifest
+			if got, err := fake.registry(t).URL(context.Background(), "ubuntu-2204-kube-v1.27"); err != nil || got != wantURL {
+				t.Errorf("resolved URL is %q (%v), want %q", got, err, wantURL)
+			}
+
+			objectInfo, err := fake.registry(t).Stat(context.Background(), "ubuntu-2204-kube-v1.27")
+			if err != nil {
+				t.Fatalf("stat failed: %v", err)
+			}
+			if objectInfo.Size != int64(len(content)) {
+				t.Errorf("size is %d, want %d", objectInfo.Size, len(content))
+			}
+			if got := objectInfo.Metadata[MetadataInputHash]; got != "abc" {
+				t.Errorf("metadata %s is %q, want %q", MetadataInputHash, got, "abc")
+			}
+		})
+	}
+}
+
+func TestOCIUpdateMetadata(t *testing.T) {
+	fake := newFakeOCIRegistry(t, false)
+	registry := fake.registry(t)
+
+	content := "node image"
+	metadata := map[string]string{MetadataInputHash: "abc", MetadataMinDisk: "20"}
+	if err := registry.UploadWithMetadata(context.Background(), "ubuntu-2204-kube-v1.27", strings.NewReader(content), int64(len(content)), metadata); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	blobs := len(fake.blobs)
+
+	if err := registry.UpdateMetadata(context.Background(), "ubuntu-2204-kube-v1.27", map[string]string{MetadataInputHash: "def"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if len(fake.blobs) != blobs {
+		t.Errorf("got %d blobs after update, want %d", len(fake.blobs), blobs)
+	}
+
+	objectInfo, err := registry.Stat(context.Background(), "ubuntu-2204-kube-v1.27")
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if want := map[string]string{MetadataInputHash: "def"}; !reflect.DeepEqual(objectInfo.Metadata, want) {
+		t.Errorf("metadata is %v, want %v", objectInfo.Metadata, want)
+	}
+	if objectInfo.Size != int64(len(content)) || objectInfo.LastModified.IsZero() {
+		t.Errorf("size %d and creation time %v of the object were not kept", objectInfo.Size, objectInfo.LastModified)
+	}
+
+	if err := registry.UpdateMetadata(context.Background(), "missing", metadata); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected %v, got %v", ErrObjectNotFound, err)
+	}
+}
+
+func TestOCIStatNotFound(t *testing.T) {
+	fake := newFakeOCIRegistry(t, false)
+	_, err := fake.registry(t).Stat(context.Background(), "missing")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound, got %v", err)
+	}
+	if url, err := fake.registry(t).URL(context.Background(), "missing"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound for URL, got %q (%v)", url, err)
+	}
+}
+
+func TestOCIListAndDelete(t *testing.T) {
+	fake := newFakeOCIRegistry(t, false)
+	registry := fake.registry(t)
+
+	names := []string{"image-a", "image-b", "image-c"}
+	for _, name := range names {
+		if err := registry.Upload(context.Background(), name, strings.NewReader(name), int64(len(name))); err != nil {
+			t.Fatalf("upload of %s failed: %v", name, err)
+		}
+	}
+
+	objectInfos, err := registry.List(context.Background())
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	var listed []string
+	for _, objectInfo := range objectInfos {
+		listed = append(listed, objectInfo.Name)
+	}
+	if strings.Join(listed, ",") != strings.Join(names, ",") {
+		t.Errorf("listed %v, want %v", listed, names)
+	}
+
+	if err := registry.Delete(context.Background(), "image-b"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, err := registry.Stat(context.Background(), "image-b"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound after delete, got %v", err)
+	}
+}
+
+func TestOCIUploadCanceledOnFailure(t *testing.T) {
+	fake := newFakeOCIRegistry(t, false)
+	fake.failPatch = true
+
+	content := "node image"
+	if err := fake.registry(t).Upload(context.Background(), "image", strings.NewReader(content), int64(len(content))); err == nil {
+		t.Fatal("expected upload to fail")
+	}
+	if fake.canceledUploads != 1 {
+		t.Errorf("canceled %d uploads, want 1", fake.canceledUploads)
+	}
+	if len(fake.manifests) != 0 {
+		t.Errorf("manifests %v were pushed although the upload failed", fake.manifests)
+	}
+}
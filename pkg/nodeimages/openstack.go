@@ -0,0 +1,125 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+)
+
+// keystoneAuthOptions returns the Keystone authentication options.
+// If `authURL` is defined in registry.yaml, `accessKey` and `secretKey` are used as application credential ID and secret,
+// otherwise the standard OS_* environment variables are used.
+func keystoneAuthOptions(registryConfig *RegistryConfig) (gophercloud.AuthOptions, error) {
+	if registryConfig.Config.AuthURL == "" {
+		authOpts, err := openstack.AuthOptionsFromEnv()
+		if err != nil {
+			return gophercloud.AuthOptions{}, fmt.Errorf("error reading OpenStack credentials from environment: %w", err)
+		}
+		return authOpts, nil
+	}
+
+	if registryConfig.Config.AccessKey == "" || registryConfig.Config.SecretKey == "" {
+		return gophercloud.AuthOptions{}, fmt.Errorf("fields 'accessKey' and 'secretKey' must be defined when 'authURL' is set")
+	}
+
+	return gophercloud.AuthOptions{
+		IdentityEndpoint:            registryConfig.Config.AuthURL,
+		ApplicationCredentialID:     registryConfig.Config.AccessKey,
+		ApplicationCredentialSecret: registryConfig.Config.SecretKey,
+	}, nil
+}
+
+// newProviderClient returns a provider client authenticated against Keystone. The given context is used for the
+// authentication, the requests of an operation have to use a copy of the client with its context, see withContext.
+func newProviderClient(ctx context.Context, registryConfig *RegistryConfig) (*gophercloud.ProviderClient, error) {
+	authOpts, err := keystoneAuthOptions(registryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	providerClient, err := openstack.NewClient(authOpts.IdentityEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OpenStack client: %w", err)
+	}
+	providerClient.Context = ctx
+
+	// TLS configuration
+	config, err := tlsConfig(registryConfig)
+	if err != nil {
+		return nil, err
+	}
+	providerClient.HTTPClient = http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: config,
+		},
+	}
+
+	if err := openstack.Authenticate(providerClient, authOpts); err != nil {
+		return nil, fmt.Errorf("error authenticating against Keystone: %w", err)
+	}
+	return providerClient, nil
+}
+
+// withContext returns a copy of the service client whose requests are canceled with ctx, as gophercloud only supports
+// a context per provider client. The copy uses the token of the client. If the token expires, the client
+// reauthenticates and the copy takes over the new token, so the copies of concurrent operations share one token.
+func withContext(ctx context.Context, client *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+	original := client.ProviderClient
+	providerClient := &gophercloud.ProviderClient{
+		IdentityBase:      original.IdentityBase,
+		IdentityEndpoint:  original.IdentityEndpoint,
+		HTTPClient:        original.HTTPClient,
+		UserAgent:         original.UserAgent,
+		Context:           ctx,
+		RetryBackoffFunc:  original.RetryBackoffFunc,
+		MaxBackoffRetries: original.MaxBackoffRetries,
+		RetryFunc:         original.RetryFunc,
+	}
+	providerClient.CopyTokenFrom(original)
+	if original.ReauthFunc != nil {
+		providerClient.ReauthFunc = func() error {
+			if err := original.Reauthenticate(providerClient.Token()); err != nil {
+				return err //nolint:wrapcheck // gophercloud wraps the error of the reauthentication itself
+			}
+			providerClient.CopyTokenFrom(original)
+			return nil
+		}
+	}
+
+	copied := *client
+	copied.ProviderClient = providerClient
+	return &copied
+}
+
+// cleanupClient returns a copy of the service client whose requests are not canceled with the context of the
+// operation, so a partially created resource can still be deleted after the operation was interrupted.
+func cleanupClient(client *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+	cleanup := withContext(context.Background(), client)
+	cleanup.HTTPClient.Timeout = cleanupTimeout
+	return cleanup
+}
+
+// region returns the OpenStack region defined in registry.yaml or in the OS_REGION_NAME environment variable.
+func region(registryConfig *RegistryConfig) string {
+	if registryConfig.Config.Region != "" {
+		return registryConfig.Config.Region
+	}
+	return os.Getenv("OS_REGION_NAME")
+}
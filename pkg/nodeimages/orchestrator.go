@@ -0,0 +1,814 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	csctlclusterstack "github.com/SovereignCloudStack/csctl/pkg/clusterstack"
+)
+
+const (
+	// Provider is the provider type which has to be configured in csctl.yaml.
+	Provider = "openstack"
+	// DefaultOutputDirectory is the default directory in which packer stores the built node images.
+	DefaultOutputDirectory = "./output"
+
+	// MethodGet uses node images which are already stored in a registry.
+	MethodGet = "get"
+	// MethodBuild builds node images and pushes them to a registry.
+	MethodBuild = "build"
+	// MethodMirror downloads node images from their URLs and pushes them to a registry.
+	MethodMirror = "mirror"
+
+	// packerShutdownTimeout is the time packer is given to clean up after it was interrupted before it is killed.
+	packerShutdownTimeout = 2 * time.Minute
+)
+
+// Options contains the options of an Orchestrator.
+type Options struct {
+	// ClusterStackPath is the path to the cluster stack directory.
+	ClusterStackPath string
+	// ReleaseDir is the path to the cluster stack release directory in which node-images.yaml is generated.
+	ReleaseDir string
+	// RegistryConfigPath is the path to the registry.yaml file. It is required for the build method.
+	RegistryConfigPath string
+	// OutputDirectory is the directory in which packer stores the built node images, each in a subdirectory named after
+	// its image directory. Defaults to DefaultOutputDirectory.
+	OutputDirectory string
+	// FixDiskFormat corrects the disk_format of a node image if it does not match the built image instead of failing.
+	FixDiskFormat bool
+	// SkipURLVerification disables the verification of the node image URLs in the get method.
+	SkipURLVerification bool
+	// VerifyChecksums downloads every node image with a checksum in the get method and verifies the checksums.
+	VerifyChecksums bool
+	// HTTPClient is the HTTP client used to verify the node image URLs. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Parallel is the maximum number of node images which are built concurrently. Defaults to 1.
+	Parallel int
+	// KeepGoing continues building the remaining node images after a failure and reports all failures at the end.
+	KeepGoing bool
+	// ForceBuild builds all node images, even if an image with the same input hash exists in the registry.
+	ForceBuild bool
+	// Cache stores downloaded node images, so they are not downloaded again. The cache is disabled if nil.
+	Cache *Cache
+	// CacheBuiltImages also copies every built node image into the cache after it was uploaded.
+	CacheBuiltImages bool
+	// WriteBack records the URLs and other results of the build method in config.yaml of the cluster stack, which is
+	// then copied to node-images.yaml. By default, config.yaml stays untouched and the results are only recorded
+	// in node-images.yaml in the release directory.
+	WriteBack bool
+	// Out is the writer to which progress messages and the output of packer are written. Defaults to os.Stdout.
+	// Writes to Out are serialized, so it does not have to be safe for concurrent use.
+	Out io.Writer
+}
+
+// Orchestrator creates the node-images.yaml file of a cluster stack release and,
+// depending on the method defined in csctl.yaml, builds and uploads the node images.
+type Orchestrator struct {
+	opts Options
+	// templateData is used to render the templates of config.yaml. It is set by Run.
+	templateData *TemplateData
+	// resultFile is the file in which the results of the build method are recorded instead of node-images.yaml while
+	// Run builds the node images. It is only set during the build.
+	resultFile string
+}
+
+// NewOrchestrator returns an Orchestrator with the given options.
+func NewOrchestrator(opts Options) *Orchestrator {
+	if opts.OutputDirectory == "" {
+		opts.OutputDirectory = DefaultOutputDirectory
+	}
+	if opts.Out == nil {
+		opts.Out = os.Stdout
+	}
+	// Concurrent builds write to Out at the same time
+	opts.Out = newSyncWriter(opts.Out)
+	return &Orchestrator{opts: opts}
+}
+
+// ConfigPath returns the path to the config.yaml file of the cluster stack.
+func (o *Orchestrator) ConfigPath() string {
+	return filepath.Join(o.opts.ClusterStackPath, "node-images", "config.yaml")
+}
+
+// NodeImagesPath returns the path to the node-images.yaml file in the release directory.
+func (o *Orchestrator) NodeImagesPath() string {
+	return filepath.Join(o.opts.ReleaseDir, "node-images.yaml")
+}
+
+// resultPath returns the path to the file in which the results of the build method are recorded: node-images.yaml in
+// the release directory, or config.yaml of the cluster stack if WriteBack is set.
+func (o *Orchestrator) resultPath() string {
+	if o.opts.WriteBack {
+		return o.ConfigPath()
+	}
+	if o.resultFile != "" {
+		return o.resultFile
+	}
+	return o.NodeImagesPath()
+}
+
+// Run creates the node-images.yaml file in the release directory.
+// In build method, all node images are built and uploaded to the registry first and their URLs are recorded.
+// In mirror method, all node images are downloaded and uploaded to the registry first.
+func (o *Orchestrator) Run(ctx context.Context) error {
+	csctlConfig, err := csctlclusterstack.GetCsctlConfig(o.opts.ClusterStackPath)
+	if err != nil {
+		return wrapError(ErrConfigInvalid, err)
+	}
+	// Concurrent runs on the same cluster stack would overwrite each others results
+	unlock, err := lockDir(o.opts.ClusterStackPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	configFilePath := o.ConfigPath()
+	config, err := GetConfig(configFilePath)
+	if err != nil {
+		return wrapError(ErrConfigInvalid, err)
+	}
+	if csctlConfig.Config.Provider.Type != Provider {
+		return fmt.Errorf("%w in %s. Expected %s, got %s", ErrWrongProvider, o.opts.ClusterStackPath, Provider, csctlConfig.Config.Provider.Type)
+	}
+	if _, err := os.Stat(o.opts.ReleaseDir); err != nil {
+		return wrapError(ErrConfigInvalid, err)
+	}
+	var registryConfig *RegistryConfig
+	if o.opts.RegistryConfigPath != "" {
+		registryConfig, err = GetRegistryConfig(o.opts.RegistryConfigPath)
+		if err != nil {
+			return wrapError(ErrConfigInvalid, err)
+		}
+	}
+
+	// The node images are built and uploaded with rendered templates, config.yaml keeps the templates
+	o.templateData = NewTemplateData(csctlConfig, o.opts.ReleaseDir, registryConfig)
+	if err := RenderTemplates(config, o.templateData); err != nil {
+		return wrapError(ErrConfigInvalid, err)
+	}
+	if err := ValidateRenderedConfig(configFilePath, config); err != nil {
+		return wrapError(ErrConfigInvalid, err)
+	}
+
+	method := csctlConfig.Config.Provider.Config["method"]
+	switch method {
+	case MethodGet:
+		if !o.opts.SkipURLVerification {
+			if err := o.VerifyURLs(ctx, config); err != nil {
+				return err
+			}
+		}
+	case MethodBuild:
+		registry, err := o.newRegistry(ctx, MethodBuild, registryConfig)
+		if err != nil {
+			return err
+		}
+
+		if !o.opts.WriteBack {
+			// The results are only recorded in node-images.yaml, config.yaml stays untouched
+			if err := o.buildNodeImages(ctx, registry, config); err != nil {
+				return err
+			}
+			fmt.Fprintln(o.opts.Out, "Results recorded in node-images.yaml in releaseDir successfully!")
+			return nil
+		}
+
+		// Keep the previous config.yaml, as it is modified in place
+		if err := backupFile(configFilePath); err != nil {
+			return fmt.Errorf("%w: %w", ErrURLUpdateFailed, err)
+		}
+		// The results are recorded while the node images are built, config.yaml is restored if the build is interrupted
+		restoreConfig, err := snapshotFile(configFilePath)
+		if err != nil {
+			return fmt.Errorf("%w: error reading config.yaml: %w", ErrURLUpdateFailed, err)
+		}
+		if err := o.BuildAll(ctx, registry, config); err != nil {
+			if ctx.Err() != nil {
+				if restoreErr := restoreConfig(); restoreErr != nil {
+					fmt.Fprintf(o.opts.Out, "Error restoring config.yaml after interruption: %v\n", restoreErr)
+				} else {
+					fmt.Fprintln(o.opts.Out, "Build interrupted, config.yaml restored")
+				}
+			}
+			return err
+		}
+	case MethodMirror:
+		registry, err := o.newRegistry(ctx, MethodMirror, registryConfig)
+		if err != nil {
+			return err
+		}
+		if err := o.Mirror(ctx, registry, config); err != nil {
+			return err
+		}
+		// The mirrored URLs are only written to node-images.yaml, config.yaml stays untouched
+		return o.writeNodeImagesFrom(config)
+	default:
+		return fmt.Errorf("%w: unknown method %q", ErrConfigInvalid, method)
+	}
+
+	if err := o.WriteNodeImages(); err != nil {
+		return err
+	}
+	fmt.Fprintln(o.opts.Out, "config.yaml copied to releaseDir as node-images.yaml successfully!")
+	return nil
+}
+
+// buildNodeImages builds all node images and records the results in a temporary copy of node-images.yaml, which
+// replaces node-images.yaml in the release directory only once all node images are built and uploaded. A failed or
+// interrupted build leaves the previous node-images.yaml unchanged.
+func (o *Orchestrator) buildNodeImages(ctx context.Context, registry Registry, config *NodeImages) error {
+	resultFile, err := os.CreateTemp(o.opts.ReleaseDir, ".node-images.yaml.*")
+	if err != nil {
+		return fmt.Errorf("%w: error creating temporary node-images.yaml: %w", ErrURLUpdateFailed, err)
+	}
+	resultFile.Close()
+	defer os.Remove(resultFile.Name())
+
+	if err := o.writeNodeImages(resultFile.Name()); err != nil {
+		return err
+	}
+	o.resultFile = resultFile.Name()
+	defer func() { o.resultFile = "" }()
+
+	if err := o.BuildAll(ctx, registry, config); err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintln(o.opts.Out, "Build interrupted, node-images.yaml left unchanged")
+		}
+		return err
+	}
+	if err := copyFile(resultFile.Name(), o.NodeImagesPath()); err != nil {
+		return fmt.Errorf("%w: error writing node-images.yaml to releaseDir: %w", ErrURLUpdateFailed, err)
+	}
+	return nil
+}
+
+// newRegistry returns the registry defined in the registry config, which is required by the method.
+func (o *Orchestrator) newRegistry(ctx context.Context, method string, registryConfig *RegistryConfig) (Registry, error) {
+	if registryConfig == nil {
+		return nil, fmt.Errorf("%w: please specify <node-image-registry-path> or --node-image-registry when using `%s` method in csctl.yaml", ErrConfigInvalid, method)
+	}
+
+	registry, err := NewRegistry(ctx, registryConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error initializing registry: %w", ErrUploadFailed, err)
+	}
+	return registry, nil
+}
+
+// VerifyURLs verifies that the URLs of all node images are reachable and, if VerifyChecksums is set,
+// that the downloaded images match their checksums. Node images which only have an image ID are skipped.
+func (o *Orchestrator) VerifyURLs(ctx context.Context, config *NodeImages) error {
+	verifier := &URLVerifier{Client: o.opts.HTTPClient, VerifyChecksum: o.opts.VerifyChecksums, Cache: o.opts.Cache}
+
+	var errs []error
+	for _, image := range config.OpenStackNodeImages {
+		if image.URL == "" {
+			if image.ImageID == "" {
+				errs = append(errs, fmt.Errorf("field 'url' of image %s must be defined when using the %s method", image.CreateOpts.Name, MethodGet))
+			}
+			continue
+		}
+		fmt.Fprintf(o.opts.Out, "Verifying URL of image %s...\n", image.CreateOpts.Name)
+		if err := verifier.Verify(ctx, image); err != nil {
+			errs = append(errs, fmt.Errorf("image %s: %w", image.CreateOpts.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return wrapError(ErrURLVerificationFailed, errors.Join(errs...))
+	}
+	return nil
+}
+
+// BuildAll builds and uploads all node images. Up to Parallel node images are built concurrently and each is
+// uploaded as soon as its build finishes. On the first failure, all remaining builds are canceled,
+// unless KeepGoing is set, in which case all failures are reported.
+func (o *Orchestrator) BuildAll(ctx context.Context, registry Registry, config *NodeImages) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	errs := make([]error, len(config.OpenStackNodeImages))
+	workers := make(chan struct{}, max(o.opts.Parallel, 1))
+
+	for imageOrder, image := range config.OpenStackNodeImages {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(imageOrder int, image *OpenStackNodeImage) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			if err := o.buildImage(ctx, registry, image, imageOrder); err != nil {
+				errs[imageOrder] = fmt.Errorf("image %s: %w", image.CreateOpts.Name, err)
+				once.Do(func() { firstErr = errs[imageOrder] })
+				if !o.opts.KeepGoing {
+					cancel()
+				}
+			}
+		}(imageOrder, image)
+	}
+	wg.Wait()
+
+	err := firstErr
+	if o.opts.KeepGoing {
+		err = errors.Join(errs...)
+	}
+	// Node images which were not started yet when the build was interrupted have no error
+	if err == nil && ctx.Err() != nil {
+		return fmt.Errorf("%w: build interrupted: %w", ErrBuildFailed, ctx.Err())
+	}
+	return err
+}
+
+// buildImage builds the node image, unless an image with the same inputs exists, and uploads it to the registry.
+func (o *Orchestrator) buildImage(ctx context.Context, registry Registry, image *OpenStackNodeImage, imageOrder int) error {
+	inputHash, reused, err := o.reuseBuiltImage(ctx, registry, image, imageOrder)
+	if err != nil || reused {
+		return err
+	}
+	imagePath, err := o.Build(ctx, image)
+	if err != nil {
+		return err
+	}
+	if err := o.recordDiskFormat(image, imageOrder, imagePath); err != nil {
+		return err
+	}
+	if err := o.setImageSize(image, imageOrder, imagePath); err != nil {
+		return err
+	}
+	return o.upload(ctx, registry, image, imageOrder, imagePath, inputHash)
+}
+
+// buildMetadata returns the metadata stored with the built node image in the registry: the input hash and the results
+// of the build, which are restored when the node image is reused.
+func buildMetadata(image *OpenStackNodeImage, inputHash string, checksum *Checksum) map[string]string {
+	metadata := map[string]string{
+		MetadataInputHash:   inputHash,
+		MetadataSHA256:      checksum.SHA256,
+		MetadataOSHashAlgo:  checksum.OSHashAlgo,
+		MetadataOSHashValue: checksum.OSHashValue,
+	}
+	if image.CreateOpts.MinDisk > 0 {
+		metadata[MetadataMinDisk] = strconv.Itoa(image.CreateOpts.MinDisk)
+	}
+	if image.ImageSize > 0 {
+		metadata[MetadataImageSize] = strconv.FormatInt(image.ImageSize, 10)
+	}
+	return metadata
+}
+
+// buildVars returns the packer variables of the build of the node image. Every build gets its own output directory,
+// because packer fails if the output directory already exists.
+func (o *Orchestrator) buildVars(image *OpenStackNodeImage) []string {
+	return append(inputVars(image), "output_directory="+o.outputDirectory(image))
+}
+
+// inputVars returns the packer variables of the build which are part of the input hash. The output directory is
+// left out, as it only changes where the node image is stored and not the node image itself.
+func inputVars(image *OpenStackNodeImage) []string {
+	return []string{"build_name=" + image.ImageDir}
+}
+
+// outputDirectory returns the directory in which packer stores the built node image.
+func (o *Orchestrator) outputDirectory(image *OpenStackNodeImage) string {
+	return filepath.Join(o.opts.OutputDirectory, image.ImageDir)
+}
+
+// reuseBuiltImage computes the input hash of the node image and looks for an image with the same input hash in the
+// registry. If it exists, its URL, or image ID if the registry is an ImageRegistry, is recorded and the image does not
+// have to be built again. The input hash is returned, so it can be stored with the new image.
+func (o *Orchestrator) reuseBuiltImage(ctx context.Context, registry Registry, image *OpenStackNodeImage, imageOrder int) (string, bool, error) {
+	packerImagePath := filepath.Join(o.opts.ClusterStackPath, "node-images", image.ImageDir)
+	if fileInfo, err := os.Stat(packerImagePath); image.ImageDir == "" || err != nil || !fileInfo.IsDir() {
+		// Build reports the invalid image directory
+		return "", false, nil
+	}
+
+	inputHash, err := InputHash(packerImagePath, inputVars(image))
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %w", ErrBuildFailed, err)
+	}
+	if o.opts.ForceBuild {
+		return inputHash, false, nil
+	}
+
+	_, isImageRegistry := registry.(ImageRegistry)
+	objectName := image.ImageDir
+	if isImageRegistry {
+		objectName = image.CreateOpts.Name
+	}
+	objectInfo, err := registry.Stat(ctx, objectName)
+	if err != nil {
+		if !errors.Is(err, ErrObjectNotFound) {
+			fmt.Fprintf(o.imageOut(image), "Warning: error looking up image %s in registry, building it: %v\n", image.CreateOpts.Name, err)
+		}
+		return inputHash, false, nil
+	}
+	if objectInfo.Metadata[MetadataInputHash] != inputHash {
+		return inputHash, false, nil
+	}
+
+	var url string
+	if isImageRegistry {
+		fmt.Fprintf(o.imageOut(image), "Inputs of image %s are unchanged, reusing image %s\n", image.CreateOpts.Name, objectInfo.ID)
+		if err := o.recordImageID(image, objectInfo.ID, imageOrder); err != nil {
+			return "", false, err
+		}
+	} else {
+		url, err = registry.URL(ctx, objectName)
+		if err != nil {
+			fmt.Fprintf(o.imageOut(image), "Warning: error getting URL of image %s in registry, building it: %v\n", image.CreateOpts.Name, err)
+			return inputHash, false, nil
+		}
+		fmt.Fprintf(o.imageOut(image), "Inputs of image %s are unchanged, reusing %s\n", image.CreateOpts.Name, url)
+		if err := o.recordURL(image, url, imageOrder); err != nil {
+			return "", false, err
+		}
+	}
+	if err := o.restoreBuildResults(image, imageOrder, url, objectInfo.Metadata); err != nil {
+		return "", false, err
+	}
+	return inputHash, true, nil
+}
+
+// restoreBuildResults records min_disk, image_size and the checksums stored as metadata with the reused node image,
+// like they are recorded after a build. The checksums of node images uploaded without them are taken from the cache
+// if the image is still in it.
+func (o *Orchestrator) restoreBuildResults(image *OpenStackNodeImage, imageOrder int, url string, metadata map[string]string) error {
+	minDisk, _ := strconv.Atoi(metadata[MetadataMinDisk])
+	imageSize, _ := strconv.ParseInt(metadata[MetadataImageSize], 10, 64)
+	if minDisk > 0 || imageSize > 0 {
+		if minDisk > 0 && image.CreateOpts.MinDisk == 0 {
+			image.CreateOpts.MinDisk = minDisk
+		}
+		if imageSize > 0 {
+			image.ImageSize = imageSize
+		}
+
+		resultPath := o.resultPath()
+		err := updateNodeImage(resultPath, imageOrder, func(configImage *OpenStackNodeImage) {
+			configImage.CreateOpts.MinDisk = image.CreateOpts.MinDisk
+			configImage.ImageSize = image.ImageSize
+		})
+		if err != nil {
+			return fmt.Errorf("%w: error updating image size in %s: %w", ErrURLUpdateFailed, filepath.Base(resultPath), err)
+		}
+	}
+
+	checksum := &Checksum{
+		SHA256:      metadata[MetadataSHA256],
+		OSHashAlgo:  metadata[MetadataOSHashAlgo],
+		OSHashValue: metadata[MetadataOSHashValue],
+	}
+	if !sha256Regex.MatchString(checksum.SHA256) {
+		checksum = nil
+		if url != "" && o.opts.Cache != nil {
+			if _, cachedChecksum, ok := o.opts.Cache.Lookup(url, nil); ok {
+				checksum = cachedChecksum
+			}
+		}
+	}
+	if checksum == nil {
+		return nil
+	}
+	return o.setChecksum(image, imageOrder, url, checksum)
+}
+
+// Build runs packer build for the image directory of the node image and returns the path to the built image.
+func (o *Orchestrator) Build(ctx context.Context, image *OpenStackNodeImage) (string, error) {
+	if image.ImageDir == "" {
+		return "", fmt.Errorf("%w: no images to build, image directory is not defined in config.yaml file", ErrConfigInvalid)
+	}
+
+	// Construct the path to the image folder
+	packerImagePath := filepath.Join(o.opts.ClusterStackPath, "node-images", image.ImageDir)
+
+	if _, err := os.Stat(packerImagePath); err != nil {
+		return "", fmt.Errorf("%w: image folder %s does not exist", ErrConfigInvalid, packerImagePath)
+	}
+	out := o.imageOut(image)
+	fmt.Fprintf(out, "Running packer build of image %s...\n", image.CreateOpts.Name)
+	// Warning: variables like build_name and output_directory must exist in packer variables file like in example
+	// #nosec G204
+	args := []string{"build"}
+	for _, buildVar := range o.buildVars(image) {
+		args = append(args, "-var", buildVar)
+	}
+	cmd := exec.CommandContext(ctx, "packer", append(args, packerImagePath)...)
+	// On cancellation, packer is interrupted instead of killed, so it can stop its VM and remove temporary resources
+	cmd.WaitDelay = packerShutdownTimeout
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := runPacker(cmd)
+	// An incomplete last line of packer must not be joined with the next message
+	if output, ok := out.(*prefixWriter); ok {
+		output.Flush()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("%w: packer build interrupted: %w", ErrBuildFailed, ctx.Err())
+		}
+		return "", fmt.Errorf("%w: error running packer build: %w", ErrBuildFailed, err)
+	}
+	fmt.Fprintf(out, "Packer build of image %s completed successfully.\n", image.CreateOpts.Name)
+
+	// Path to the image created by the packer
+	// Warning: name of the image created by packer should have same name as the name of the image folder in node-images
+	ouputImagePath := filepath.Join(o.outputDirectory(image), image.ImageDir)
+	if !filepath.IsAbs(ouputImagePath) {
+		// Get the current working directory
+		currentDir, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("error getting current working directory: %w", err)
+		}
+		ouputImagePath = filepath.Join(currentDir, ouputImagePath)
+	}
+	return ouputImagePath, nil
+}
+
+// imageOut returns the writer for the messages of the node image. If node images are built concurrently, every line is
+// prefixed with the image directory to tell the outputs of concurrent builds apart.
+func (o *Orchestrator) imageOut(image *OpenStackNodeImage) io.Writer {
+	if o.opts.Parallel <= 1 {
+		return o.opts.Out
+	}
+	return newPrefixWriter(o.opts.Out, "["+image.ImageDir+"] ")
+}
+
+// recordDiskFormat compares the disk_format of the node image with the format detected from the header of the built
+// image. If they differ, it fails or, if FixDiskFormat is set, records the corrected disk_format.
+func (o *Orchestrator) recordDiskFormat(image *OpenStackNodeImage, imageOrder int, imagePath string) error {
+	corrected, err := o.checkDiskFormat(image, imagePath)
+	if err != nil || !corrected {
+		return err
+	}
+
+	resultPath := o.resultPath()
+	err = updateNodeImage(resultPath, imageOrder, func(configImage *OpenStackNodeImage) {
+		configImage.CreateOpts.DiskFormat = image.CreateOpts.DiskFormat
+	})
+	if err != nil {
+		return fmt.Errorf("%w: error updating disk_format in %s: %w", ErrURLUpdateFailed, filepath.Base(resultPath), err)
+	}
+	return nil
+}
+
+// checkDiskFormat compares the disk_format of the node image with the format detected from the image file and
+// corrects it if FixDiskFormat is set. It reports whether the disk_format of the node image was corrected.
+func (o *Orchestrator) checkDiskFormat(image *OpenStackNodeImage, imagePath string) (bool, error) {
+	if !slices.Contains(detectableDiskFormats, image.CreateOpts.DiskFormat) {
+		return false, nil
+	}
+
+	diskFormat, err := DetectDiskFormat(imagePath)
+	if err != nil {
+		return false, fmt.Errorf("%w: error detecting disk format of image: %w", ErrBuildFailed, err)
+	}
+	if diskFormat == image.CreateOpts.DiskFormat {
+		return false, nil
+	}
+
+	if !o.opts.FixDiskFormat {
+		return false, fmt.Errorf("%w: disk_format of image %s is %q, but the image file %s is %q",
+			ErrConfigInvalid, image.CreateOpts.Name, image.CreateOpts.DiskFormat, imagePath, diskFormat)
+	}
+
+	fmt.Fprintf(o.imageOut(image), "Correcting disk_format of image %s from %q to %q\n", image.CreateOpts.Name, image.CreateOpts.DiskFormat, diskFormat)
+	image.CreateOpts.DiskFormat = diskFormat
+	return true, nil
+}
+
+// setImageSize records the virtual size of the built qcow2 or raw image as image_size and sets min_disk if it is not
+// defined. If min_disk is smaller than the virtual size, a warning is printed.
+func (o *Orchestrator) setImageSize(image *OpenStackNodeImage, imageOrder int, imagePath string) error {
+	if image.CreateOpts.DiskFormat != DiskFormatQCOW2 && image.CreateOpts.DiskFormat != DiskFormatRaw {
+		return nil
+	}
+
+	size, err := VirtualSize(imagePath, image.CreateOpts.DiskFormat)
+	if err != nil {
+		return fmt.Errorf("%w: error reading virtual size of built image: %w", ErrBuildFailed, err)
+	}
+	minDisk := sizeToGiB(size)
+
+	switch {
+	case image.CreateOpts.MinDisk == 0:
+		fmt.Fprintf(o.imageOut(image), "Setting min_disk of image %s to %d GiB\n", image.CreateOpts.Name, minDisk)
+		image.CreateOpts.MinDisk = minDisk
+	case image.CreateOpts.MinDisk < minDisk:
+		fmt.Fprintf(o.imageOut(image), "Warning: min_disk of image %s is %d GiB, but its virtual size is %d GiB\n", image.CreateOpts.Name, image.CreateOpts.MinDisk, minDisk)
+	}
+	image.ImageSize = size
+
+	resultPath := o.resultPath()
+	err = updateNodeImage(resultPath, imageOrder, func(configImage *OpenStackNodeImage) {
+		configImage.CreateOpts.MinDisk = image.CreateOpts.MinDisk
+		configImage.ImageSize = size
+	})
+	if err != nil {
+		return fmt.Errorf("%w: error updating image size in %s: %w", ErrURLUpdateFailed, filepath.Base(resultPath), err)
+	}
+	return nil
+}
+
+// upload uploads the built image to the registry and records its URL, or its image ID if the registry is an
+// ImageRegistry, for the node image at the given position. The build metadata with the checksums computed while
+// uploading is stored once the upload has completed, so an interrupted upload is never reused. For an ImageRegistry,
+// the metadata is stored as image properties.
+func (o *Orchestrator) upload(ctx context.Context, registry Registry, image *OpenStackNodeImage, imageOrder int, imagePath, inputHash string) error {
+	// Upload the built image directly into Glance if the registry supports it
+	if imageRegistry, ok := registry.(ImageRegistry); ok {
+		imageID, checksum, err := o.reuseIdenticalImage(ctx, imageRegistry, image, imagePath)
+		if err != nil {
+			return err
+		}
+		if imageID == "" {
+			imageID, checksum, err = UploadImageFile(ctx, imageRegistry, imagePath, image.CreateOpts)
+			if err != nil {
+				return fmt.Errorf("%w: error uploading image to Glance: %w", ErrUploadFailed, err)
+			}
+		}
+		if err := imageRegistry.UpdateImageProperties(ctx, imageID, buildMetadata(image, inputHash, checksum)); err != nil {
+			return fmt.Errorf("%w: error storing build metadata in Glance: %w", ErrUploadFailed, err)
+		}
+
+		if err := o.recordImageID(image, imageID, imageOrder); err != nil {
+			return err
+		}
+		return o.setChecksum(image, imageOrder, "", checksum)
+	}
+
+	// Push the built image to the registry
+	checksum, err := UploadFile(ctx, registry, imagePath, image.ImageDir)
+	if err != nil {
+		return fmt.Errorf("%w: error pushing image to registry: %w", ErrUploadFailed, err)
+	}
+	if metadataRegistry, ok := registry.(MetadataRegistry); ok {
+		if err := metadataRegistry.UpdateMetadata(ctx, image.ImageDir, buildMetadata(image, inputHash, checksum)); err != nil {
+			return fmt.Errorf("%w: error storing build metadata in registry: %w", ErrUploadFailed, err)
+		}
+	}
+
+	// Update URL if it is necessary
+	url, err := registry.URL(ctx, image.ImageDir)
+	if err != nil {
+		return fmt.Errorf("%w: error getting URL of image %s: %w", ErrUploadFailed, image.CreateOpts.Name, err)
+	}
+	if err := o.recordURL(image, url, imageOrder); err != nil {
+		return err
+	}
+
+	// Keep the uploaded image, so it does not have to be downloaded again from its URL
+	if o.opts.Cache != nil && o.opts.CacheBuiltImages {
+		if _, _, err := o.opts.Cache.Add(url, imagePath, checksum); err != nil {
+			fmt.Fprintf(o.imageOut(image), "Warning: error adding image %s to cache: %v\n", image.CreateOpts.Name, err)
+		}
+	}
+	return o.setChecksum(image, imageOrder, url, checksum)
+}
+
+// reuseIdenticalImage looks for an active image with the name of the node image in the image registry whose data is
+// identical to the built image, so the built image is not uploaded a second time under the same name. The checksums
+// of the built image are only computed if an image with that name exists. It returns the ID of the identical image
+// and the checksums, or an empty ID if the built image has to be uploaded.
+func (o *Orchestrator) reuseIdenticalImage(ctx context.Context, registry ImageRegistry, image *OpenStackNodeImage, imagePath string) (string, *Checksum, error) {
+	existing, err := statImage(ctx, registry, image.CreateOpts.Name)
+	if err != nil || existing == nil {
+		return "", nil, err
+	}
+
+	checksum, err := FileChecksum(imagePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: error computing checksum of built image: %w", ErrBuildFailed, err)
+	}
+	if !identicalImage(existing, checksum) {
+		return "", nil, nil
+	}
+	fmt.Fprintf(o.imageOut(image), "Image %s already exists in Glance as image %s, skipping upload\n", image.CreateOpts.Name, existing.ID)
+	return existing.ID, checksum, nil
+}
+
+// statImage returns the most recently created active image with the given name in the image registry, or nil if
+// there is none.
+func statImage(ctx context.Context, registry ImageRegistry, name string) (*ObjectInfo, error) {
+	objectInfo, err := registry.Stat(ctx, name)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: error getting image %s from Glance: %w", ErrUploadFailed, name, err)
+	}
+	return objectInfo, nil
+}
+
+// identicalImage reports whether the os_hash_value computed by Glance for the image matches the checksum.
+func identicalImage(objectInfo *ObjectInfo, checksum *Checksum) bool {
+	hashValue := objectInfo.Metadata["os_hash_value"]
+	return hashValue != "" && objectInfo.Metadata["os_hash_algo"] == checksum.OSHashAlgo &&
+		strings.EqualFold(hashValue, checksum.OSHashValue)
+}
+
+// recordURL records the URL of the node image at the given position, unless it already has one.
+func (o *Orchestrator) recordURL(image *OpenStackNodeImage, url string, imageOrder int) error {
+	resultPath := o.resultPath()
+	updated, err := updateURLNodeImages(resultPath, url, imageOrder)
+	if err != nil {
+		return fmt.Errorf("%w: error updating URL in %s: %w", ErrURLUpdateFailed, filepath.Base(resultPath), err)
+	}
+	if updated {
+		fmt.Fprintf(o.imageOut(image), "URL updated for image %s: %s\n", image.CreateOpts.Name, url)
+	} else {
+		fmt.Fprintf(o.imageOut(image), "URL already exists for image %s\n", image.CreateOpts.Name)
+	}
+	return nil
+}
+
+// recordImageID records the image ID of the node image at the given position.
+func (o *Orchestrator) recordImageID(image *OpenStackNodeImage, imageID string, imageOrder int) error {
+	resultPath := o.resultPath()
+	if err := updateImageIDNodeImages(resultPath, imageID, imageOrder); err != nil {
+		return fmt.Errorf("%w: error updating image ID in %s: %w", ErrURLUpdateFailed, filepath.Base(resultPath), err)
+	}
+	fmt.Fprintf(o.imageOut(image), "Image ID updated for image %s: %s\n", image.CreateOpts.Name, imageID)
+	return nil
+}
+
+// setChecksum records the checksums of the uploaded image. If url is set, the checksums are only recorded if the node
+// image points to the uploaded image, and not to a URL defined by the user.
+func (o *Orchestrator) setChecksum(image *OpenStackNodeImage, imageOrder int, url string, checksum *Checksum) error {
+	resultPath := o.resultPath()
+	err := updateNodeImage(resultPath, imageOrder, func(configImage *OpenStackNodeImage) {
+		if url == "" || configImage.URL == url {
+			configImage.Checksum = checksum
+			image.Checksum = checksum
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("%w: error updating checksum in %s: %w", ErrURLUpdateFailed, filepath.Base(resultPath), err)
+	}
+	return nil
+}
+
+// WriteNodeImages generates the node-images.yaml file in the release directory from config.yaml.
+// The templates of config.yaml are rendered once Run has loaded the template data.
+func (o *Orchestrator) WriteNodeImages() error {
+	return o.writeNodeImages(o.NodeImagesPath())
+}
+
+// writeNodeImages copies config.yaml to dest, with rendered templates once Run has loaded the template data.
+func (o *Orchestrator) writeNodeImages(dest string) error {
+	if o.templateData != nil {
+		if err := renderNodeImagesFile(o.ConfigPath(), dest, o.templateData); err != nil {
+			return fmt.Errorf("%w: error rendering config.yaml to releaseDir: %w", ErrURLUpdateFailed, err)
+		}
+	} else if err := copyFile(o.ConfigPath(), dest); err != nil {
+		return fmt.Errorf("%w: error copying config.yaml to releaseDir: %w", ErrURLUpdateFailed, err)
+	}
+	return nil
+}
+
+// writeNodeImagesFrom generates the node-images.yaml file in the release directory from config.yaml with the values
+// of the given node images. Like in WriteNodeImages, comments and fields unknown to the plugin are kept.
+func (o *Orchestrator) writeNodeImagesFrom(config *NodeImages) error {
+	dest := o.NodeImagesPath()
+	if err := writeNodeImagesFile(o.ConfigPath(), dest, config); err != nil {
+		return fmt.Errorf("%w: error writing node-images.yaml to releaseDir: %w", ErrURLUpdateFailed, err)
+	}
+	fmt.Fprintln(o.opts.Out, "node-images.yaml written to releaseDir successfully!")
+	return nil
+}
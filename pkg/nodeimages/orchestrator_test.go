@@ -0,0 +1,316 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBuildAllParallelOutput(t *testing.T) {
+	imageDirs := []string{"ubuntu-2204", "ubuntu-2404", "debian-12"}
+
+	clusterStackPath := t.TempDir()
+	releaseDir := t.TempDir()
+	registryConfig := &RegistryConfig{Type: RegistryTypeLocal}
+	registryConfig.Config.Directory = t.TempDir()
+	registryConfig.Config.BaseURL = "https://images.example.com"
+	registry := &localRegistry{config: registryConfig}
+
+	config := &NodeImages{APIVersion: "v1"}
+	nodeImages := "apiVersion: v1\nopenStackNodeImages:\n"
+	for _, imageDir := range imageDirs {
+		packerImagePath := filepath.Join(clusterStackPath, "node-images", imageDir)
+		if err := os.MkdirAll(filepath.Dir(packerImagePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(writeTestImageDir(t), packerImagePath); err != nil {
+			t.Fatal(err)
+		}
+
+		// Every node image was built before, so no packer build is run
+		image := &OpenStackNodeImage{ImageDir: imageDir, CreateOpts: &CreateOpts{Name: imageDir, DiskFormat: DiskFormatQCOW2}}
+		inputHash, err := InputHash(packerImagePath, inputVars(image))
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata := map[string]string{MetadataInputHash: inputHash}
+		if err := registry.UploadWithMetadata(context.Background(), imageDir, strings.NewReader(testImageContent), int64(len(testImageContent)), metadata); err != nil {
+			t.Fatal(err)
+		}
+		config.OpenStackNodeImages = append(config.OpenStackNodeImages, image)
+		nodeImages += "  - imageDir: " + imageDir + "\n    createOpts:\n      name: " + imageDir + "\n"
+	}
+	writeFile(t, filepath.Join(releaseDir, "node-images.yaml"), nodeImages, 0o644)
+
+	out := &bytes.Buffer{}
+	o := NewOrchestrator(Options{ClusterStackPath: clusterStackPath, ReleaseDir: releaseDir, Parallel: 2, Out: out})
+	if err := o.BuildAll(context.Background(), registry, config); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2*len(imageDirs) {
+		t.Fatalf("expected %d lines, got %q", 2*len(imageDirs), lines)
+	}
+	for _, imageDir := range imageDirs {
+		for _, want := range []string{
+			"[" + imageDir + "] Inputs of image " + imageDir + " are unchanged, reusing https://images.example.com/" + imageDir,
+			"[" + imageDir + "] URL updated for image " + imageDir + ": https://images.example.com/" + imageDir,
+		} {
+			if !strings.Contains(out.String(), want+"\n") {
+				t.Errorf("output does not contain %q:\n%s", want, out.String())
+			}
+		}
+	}
+}
+
+func TestUploadReusesIdenticalGlanceImage(t *testing.T) {
+	tests := []struct {
+		name            string
+		existingContent string
+		wantImageID     string
+		wantImages      int
+	}{
+		{name: "no image", wantImageID: "image-1", wantImages: 1},
+		{name: "identical image", existingContent: testImageContent, wantImageID: "image-1", wantImages: 1},
+		{name: "different image", existingContent: "previous node image", wantImageID: "image-2", wantImages: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeGlance{}
+			registry := newTestGlanceRegistry(t, fake)
+			if tt.existingContent != "" {
+				existingPath := filepath.Join(t.TempDir(), "existing.img")
+				writeFile(t, existingPath, tt.existingContent, 0o644)
+				createOpts := &CreateOpts{Name: "ubuntu", DiskFormat: DiskFormatRaw, ContainerFormat: "bare"}
+				if _, _, err := UploadImageFile(context.Background(), registry, existingPath, createOpts); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			releaseDir := t.TempDir()
+			writeFile(t, filepath.Join(releaseDir, "node-images.yaml"), "apiVersion: v1\nopenStackNodeImages:\n  - createOpts:\n      name: ubuntu\n", 0o644)
+			imagePath := filepath.Join(t.TempDir(), "ubuntu.img")
+			writeFile(t, imagePath, testImageContent, 0o644)
+
+			image := &OpenStackNodeImage{ImageDir: "ubuntu", CreateOpts: &CreateOpts{Name: "ubuntu", DiskFormat: DiskFormatRaw, ContainerFormat: "bare"}}
+			out := &bytes.Buffer{}
+			o := NewOrchestrator(Options{ReleaseDir: releaseDir, Out: out})
+			if err := o.upload(context.Background(), registry, image, 0, imagePath, "input-hash"); err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+
+			if len(fake.images) != tt.wantImages {
+				t.Errorf("Glance has %d images, want %d", len(fake.images), tt.wantImages)
+			}
+			if got := fake.images[tt.wantImageID][MetadataInputHash]; got != "input-hash" {
+				t.Errorf("input hash of image %s is %v, want %q", tt.wantImageID, got, "input-hash")
+			}
+			data, err := os.ReadFile(filepath.Join(releaseDir, "node-images.yaml"))
+			if err != nil || !strings.Contains(string(data), "imageID: "+tt.wantImageID) {
+				t.Errorf("node-images.yaml does not record image ID %s (%v):\n%s", tt.wantImageID, err, data)
+			}
+		})
+	}
+}
+
+func TestUploadCachesBuiltImages(t *testing.T) {
+	for _, cacheBuiltImages := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cacheBuiltImages=%t", cacheBuiltImages), func(t *testing.T) {
+			registry := newTestLocalRegistry(t, "images", "https://images.example.com")
+			cache := NewCache(t.TempDir(), 0)
+
+			releaseDir := t.TempDir()
+			writeFile(t, filepath.Join(releaseDir, "node-images.yaml"), "apiVersion: v1\nopenStackNodeImages:\n  - imageDir: ubuntu\n    createOpts:\n      name: ubuntu\n", 0o644)
+			imagePath := filepath.Join(t.TempDir(), "ubuntu.img")
+			writeFile(t, imagePath, testImageContent, 0o644)
+
+			image := &OpenStackNodeImage{ImageDir: "ubuntu", CreateOpts: &CreateOpts{Name: "ubuntu", DiskFormat: DiskFormatRaw}}
+			o := NewOrchestrator(Options{ReleaseDir: releaseDir, Cache: cache, CacheBuiltImages: cacheBuiltImages, Out: &bytes.Buffer{}})
+			if err := o.upload(context.Background(), registry, image, 0, imagePath, "input-hash"); err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+
+			_, _, cached := cache.Lookup("https://images.example.com/images/ubuntu", nil)
+			if cached != cacheBuiltImages {
+				t.Errorf("built image is cached is %t, want %t", cached, cacheBuiltImages)
+			}
+		})
+	}
+}
+
+// writeFakePacker writes a packer script with the given body to a directory at the start of PATH.
+func writeFakePacker(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake packer is a shell script")
+	}
+	binDir := t.TempDir()
+	writeFile(t, filepath.Join(binDir, "packer"), "#!/bin/sh\n"+script, 0o755)
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestBuildFlushesIncompleteLine(t *testing.T) {
+	writeFakePacker(t, "printf 'Build finished: 100%%'\n")
+	clusterStackPath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(clusterStackPath, "node-images", "ubuntu"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	o := NewOrchestrator(Options{ClusterStackPath: clusterStackPath, Parallel: 2, Out: out})
+	image := &OpenStackNodeImage{ImageDir: "ubuntu", CreateOpts: &CreateOpts{Name: "ubuntu"}}
+	if _, err := o.Build(context.Background(), image); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	want := "[ubuntu] Running packer build of image ubuntu...\n" +
+		"[ubuntu] Build finished: 100%\n" +
+		"[ubuntu] Packer build of image ubuntu completed successfully.\n"
+	if out.String() != want {
+		t.Errorf("output is\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestRunBuildResults(t *testing.T) {
+	const (
+		configYAML = "apiVersion: v1\nopenStackNodeImages:\n  - url: \"\"\n    imageDir: ubuntu\n    createOpts:\n" +
+			"      name: ubuntu\n      disk_format: raw\n      container_format: bare\n"
+		previousNodeImages = "apiVersion: v1\nopenStackNodeImages:\n  - url: https://images.example.com/previous\n"
+	)
+
+	tests := []struct {
+		name               string
+		writeBack          bool
+		previousNodeImages bool
+		packerFails        bool
+		interrupted        bool
+		wantURL            bool
+		wantOut            string
+	}{
+		{name: "default", wantURL: true},
+		{name: "default failed", packerFails: true},
+		{name: "default failed with previous node-images.yaml", previousNodeImages: true, packerFails: true},
+		{name: "default interrupted", previousNodeImages: true, interrupted: true, wantOut: "Build interrupted, node-images.yaml left unchanged"},
+		{name: "write-back", writeBack: true, wantURL: true},
+		{name: "write-back interrupted", writeBack: true, interrupted: true, wantOut: "Build interrupted, config.yaml restored"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.packerFails {
+				writeFakePacker(t, "exit 1\n")
+			} else {
+				writeFakePacker(t, "exit 0\n")
+			}
+			clusterStackPath := t.TempDir()
+			writeFile(t, filepath.Join(clusterStackPath, "csctl.yaml"), "apiVersion: csctl.clusterstack.x-k8s.io/v1alpha1\n"+
+				"config:\n  kubernetesVersion: v1.30.2\n  clusterStackName: ferrol\n  provider:\n    type: openstack\n"+
+				"    apiVersion: openstack.csctl.clusterstack.x-k8s.io/v1alpha1\n    config:\n      method: build\n", 0o644)
+			if err := os.MkdirAll(filepath.Join(clusterStackPath, "node-images", "ubuntu"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			configPath := filepath.Join(clusterStackPath, "node-images", "config.yaml")
+			writeFile(t, configPath, configYAML, 0o644)
+			registryConfigPath := filepath.Join(t.TempDir(), "registry.yaml")
+			writeFile(t, registryConfigPath, fmt.Sprintf("type: Local\nconfig:\n  directory: %s\n  baseURL: https://images.example.com\n", t.TempDir()), 0o644)
+			// The fake packer does not build anything, the image is already in the output directory
+			outputDirectory := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(outputDirectory, "ubuntu"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, filepath.Join(outputDirectory, "ubuntu", "ubuntu"), testImageContent, 0o644)
+
+			releaseDir := t.TempDir()
+			nodeImagesPath := filepath.Join(releaseDir, "node-images.yaml")
+			if tt.previousNodeImages {
+				writeFile(t, nodeImagesPath, previousNodeImages, 0o644)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.interrupted {
+				cancel()
+			}
+			out := &bytes.Buffer{}
+			o := NewOrchestrator(Options{
+				ClusterStackPath:   clusterStackPath,
+				ReleaseDir:         releaseDir,
+				RegistryConfigPath: registryConfigPath,
+				OutputDirectory:    outputDirectory,
+				WriteBack:          tt.writeBack,
+				Out:                out,
+			})
+			err := o.Run(ctx)
+			if tt.packerFails || tt.interrupted {
+				if !errors.Is(err, ErrBuildFailed) {
+					t.Fatalf("run returned error %v, want %v", err, ErrBuildFailed)
+				}
+			} else if err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if !strings.Contains(out.String(), tt.wantOut) {
+				t.Errorf("output is\n%s\nwant it to contain %q", out.String(), tt.wantOut)
+			}
+
+			nodeImages, err := os.ReadFile(nodeImagesPath)
+			switch {
+			case tt.wantURL:
+				if err != nil || !strings.Contains(string(nodeImages), "url: https://images.example.com/") {
+					t.Errorf("node-images.yaml does not record the URL (%v):\n%s", err, nodeImages)
+				}
+			case tt.previousNodeImages:
+				if string(nodeImages) != previousNodeImages {
+					t.Errorf("node-images.yaml is\n%s\nwant it unchanged", nodeImages)
+				}
+			case !os.IsNotExist(err):
+				t.Errorf("node-images.yaml exists (%v):\n%s", err, nodeImages)
+			}
+
+			config, err := os.ReadFile(configPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.writeBack && tt.wantURL {
+				if !strings.Contains(string(config), "url: https://images.example.com/") {
+					t.Errorf("config.yaml does not record the URL:\n%s", config)
+				}
+				if _, err := os.Stat(configPath + ".bak"); err != nil {
+					t.Errorf("backup of config.yaml is missing: %v", err)
+				}
+			} else if string(config) != configYAML {
+				t.Errorf("config.yaml is\n%s\nwant it unchanged", config)
+			}
+
+			entries, err := os.ReadDir(releaseDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), ".") {
+					t.Errorf("temporary file %s is left in releaseDir", entry.Name())
+				}
+			}
+		})
+	}
+}
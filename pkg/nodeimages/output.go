@@ -0,0 +1,88 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// syncWriter serializes the writes to the underlying writer, so the messages of concurrent builds are not mixed.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newSyncWriter(w io.Writer) *syncWriter {
+	if sw, ok := w.(*syncWriter); ok {
+		return sw
+	}
+	return &syncWriter{w: w}
+}
+
+func (s *syncWriter) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(data) //nolint:wrapcheck // errors of the underlying writer have to be returned unchanged
+}
+
+// prefixWriter writes every line to the underlying writer with a prefix.
+// Incomplete lines are buffered until they are completed or Flush is called. All complete lines of a write are written
+// to the underlying writer at once, which has to be a syncWriter if it is shared between goroutines.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+
+	var out []byte
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		out = append(out, p.prefix...)
+		out = append(out, p.buf[:i+1]...)
+		p.buf = p.buf[i+1:]
+	}
+	if len(out) > 0 {
+		if err := p.write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush writes the buffered incomplete line. Write errors are ignored, as the output is only informational.
+func (p *prefixWriter) Flush() {
+	if len(p.buf) == 0 {
+		return
+	}
+	out := append(append(append([]byte{}, p.prefix...), p.buf...), '\n')
+	p.buf = nil
+	_ = p.write(out)
+}
+
+func (p *prefixWriter) write(out []byte) error {
+	_, err := p.w.Write(out)
+	return err //nolint:wrapcheck // errors of the underlying writer have to be returned unchanged
+}
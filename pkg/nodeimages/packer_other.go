@@ -0,0 +1,27 @@
+//go:build !(linux || darwin)
+
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import "os/exec"
+
+// runPacker runs the packer command with the default cancellation, which kills packer, as interrupting a process
+// group is not supported.
+func runPacker(cmd *exec.Cmd) error {
+	return cmd.Run() //nolint:wrapcheck // the caller wraps the error of running packer
+}
+
+// KillPackerBuilds does nothing, as packer is not started in its own process group and exits with the plugin.
+func KillPackerBuilds() {}
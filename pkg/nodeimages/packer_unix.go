@@ -0,0 +1,65 @@
+//go:build linux || darwin
+
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// packerGroups contains the process groups of the running packer builds.
+var packerGroups = struct {
+	sync.Mutex
+	pgids map[int]struct{}
+}{pgids: make(map[int]struct{})}
+
+// runPacker runs the packer command in its own process group, so a Ctrl-C in the terminal is not delivered to it a
+// second time. When the context of the command is canceled, SIGINT is sent to the whole process group, so packer and
+// the plugins it started can stop their VMs and remove temporary resources. Processes of the group which are still
+// running when packer exits, or when it is killed after WaitDelay, are killed.
+func runPacker(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+	}
+	if err := cmd.Start(); err != nil {
+		return err //nolint:wrapcheck // the caller wraps the error of running packer
+	}
+
+	pgid := cmd.Process.Pid
+	packerGroups.Lock()
+	packerGroups.pgids[pgid] = struct{}{}
+	packerGroups.Unlock()
+
+	err := cmd.Wait()
+
+	packerGroups.Lock()
+	delete(packerGroups.pgids, pgid)
+	packerGroups.Unlock()
+	_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	return err //nolint:wrapcheck // the caller wraps the error of running packer
+}
+
+// KillPackerBuilds kills the process groups of all running packer builds, so no packer process is left behind when
+// the plugin exits without waiting for the builds to clean up.
+func KillPackerBuilds() {
+	packerGroups.Lock()
+	defer packerGroups.Unlock()
+	for pgid := range packerGroups.pgids {
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
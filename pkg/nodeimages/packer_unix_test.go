@@ -0,0 +1,136 @@
+//go:build linux || darwin
+
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const fakePackerEnv = "CSCTL_OPENSTACK_FAKE_PACKER"
+
+// TestFakePackerProcess is not a real test. It is run as fake packer by TestRunPacker: the fake packer starts a child
+// process which writes its PID to the inherited stdout, like a packer plugin, and both wait to be stopped.
+func TestFakePackerProcess(*testing.T) {
+	switch os.Getenv(fakePackerEnv) {
+	case "":
+		return
+	case "packer":
+		child := exec.Command(os.Args[0], "-test.run=^TestFakePackerProcess$")
+		child.Env = append(os.Environ(), fakePackerEnv+"="+os.Getenv(fakePackerEnv+"_CHILD"))
+		child.Stdout = os.Stdout
+		if err := child.Start(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "ignore-interrupt":
+		signal.Ignore(syscall.SIGINT)
+		fmt.Printf("child %d\n", os.Getpid())
+	default:
+		fmt.Printf("child %d\n", os.Getpid())
+	}
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+func TestRunPacker(t *testing.T) {
+	tests := []struct {
+		name      string
+		child     string
+		waitDelay time.Duration
+		kill      bool
+	}{
+		// the child is interrupted together with packer, so packer does not have to be killed
+		{name: "child interrupted", child: "plugin", waitDelay: time.Minute},
+		{name: "child ignores interrupt", child: "ignore-interrupt", waitDelay: 200 * time.Millisecond},
+		{name: "killed", child: "ignore-interrupt", waitDelay: time.Minute, kill: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestFakePackerProcess$")
+			cmd.Env = append(os.Environ(), fakePackerEnv+"=packer", fakePackerEnv+"_CHILD="+tt.child)
+			cmd.WaitDelay = tt.waitDelay
+			stdout, stdoutWriter := io.Pipe()
+			cmd.Stdout = stdoutWriter
+
+			result := make(chan error, 1)
+			go func() {
+				result <- runPacker(cmd)
+				stdoutWriter.Close()
+			}()
+
+			line, err := bufio.NewReader(stdout).ReadString('\n')
+			if err != nil {
+				t.Fatalf("error reading PID of child: %v", err)
+			}
+			var childPID int
+			if _, err := fmt.Sscanf(line, "child %d", &childPID); err != nil {
+				t.Fatalf("unexpected output %q: %v", line, err)
+			}
+			go func() { _, _ = io.Copy(io.Discard, stdout) }()
+
+			if tt.kill {
+				KillPackerBuilds()
+			} else {
+				cancel()
+			}
+			select {
+			case err := <-result:
+				if err == nil {
+					t.Error("expected error of stopped packer")
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("packer did not stop")
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for !processExited(childPID) {
+				if time.Now().After(deadline) {
+					_ = syscall.Kill(childPID, syscall.SIGKILL)
+					t.Fatalf("child %d is still running", childPID)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// processExited reports whether the process does not exist anymore or is a zombie, which is not reaped if the init
+// process of a container does not reap orphans.
+func processExited(pid int) bool {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return true
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	_, state, _ := strings.Cut(string(stat), ") ")
+	return strings.HasPrefix(state, "Z")
+}
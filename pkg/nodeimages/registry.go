@@ -0,0 +1,420 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "github.com/goccy/go-yaml"
+)
+
+// RegistryConfig represents the structure of the registry.yaml file.
+// The string fields can reference environment variables like ${AWS_ACCESS_KEY_ID}.
+type RegistryConfig struct {
+	Type   string `yaml:"type"`
+	Config struct {
+		Endpoint  string `yaml:"endpoint"`
+		Bucket    string `yaml:"bucket"`
+		AccessKey string `yaml:"accessKey"`
+		SecretKey string `yaml:"secretKey"`
+		Verify    *bool  `yaml:"verify,omitempty"`
+		Cacert    string `yaml:"cacert,omitempty"`
+		ProjectID string `yaml:"projectID,omitempty"` //nolint:tagliatelle // using 'projectID' instead of 'projectId'
+		AuthURL   string `yaml:"authURL,omitempty"`   //nolint:tagliatelle // using 'authURL' instead of 'authUrl'
+		Region    string `yaml:"region,omitempty"`
+		Directory string `yaml:"directory,omitempty"`
+		BaseURL   string `yaml:"baseURL,omitempty"` //nolint:tagliatelle // using 'baseURL' instead of 'baseUrl'
+
+		// AccessKeyFile and SecretKeyFile are paths to files containing the access and secret key.
+		AccessKeyFile string `yaml:"accessKeyFile,omitempty"`
+		SecretKeyFile string `yaml:"secretKeyFile,omitempty"`
+	} `yaml:"config"`
+}
+
+// Registry types which can be defined in registry.yaml.
+const (
+	RegistryTypeS3     = "S3"
+	RegistryTypeSwift  = "Swift"
+	RegistryTypeGlance = "Glance"
+	RegistryTypeOCI    = "OCI"
+	RegistryTypeLocal  = "Local"
+)
+
+// envReferenceRegex matches a reference to an environment variable like ${AWS_ACCESS_KEY_ID}.
+var envReferenceRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ErrObjectNotFound is returned by a Registry if the requested object does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// cleanupTimeout is the timeout of the requests which clean up after an interrupted or failed upload.
+const cleanupTimeout = 30 * time.Second
+
+// ObjectInfo contains information about an object stored in a Registry.
+type ObjectInfo struct {
+	Name         string
+	Size         int64
+	LastModified time.Time
+	// ID is the ID of the object if the registry references objects by ID, e.g. the Glance image ID.
+	ID string
+	// Metadata contains the metadata stored with the object. The keys are lower case.
+	Metadata map[string]string
+}
+
+// Registry is the interface of a node image registry backend.
+type Registry interface {
+	// Upload uploads size bytes read from reader as object with the given name.
+	Upload(ctx context.Context, objectName string, reader io.Reader, size int64) error
+	// Stat returns information about the object with the given name or ErrObjectNotFound.
+	Stat(ctx context.Context, objectName string) (*ObjectInfo, error)
+	// Delete deletes the object with the given name.
+	Delete(ctx context.Context, objectName string) error
+	// List returns information about all objects in the registry.
+	List(ctx context.Context) ([]ObjectInfo, error)
+	// URL returns the public URL of the object with the given name.
+	URL(ctx context.Context, objectName string) (string, error)
+}
+
+// MetadataRegistry is implemented by registries which can store metadata with an object.
+// The metadata is returned by Stat.
+type MetadataRegistry interface {
+	Registry
+	// UploadWithMetadata uploads size bytes read from reader as object with the given name and metadata.
+	UploadWithMetadata(ctx context.Context, objectName string, reader io.Reader, size int64, metadata map[string]string) error
+	// UpdateMetadata replaces the metadata of the existing object with the given name.
+	UpdateMetadata(ctx context.Context, objectName string, metadata map[string]string) error
+}
+
+// ImageRegistry is implemented by registries which store node images directly as images in Glance
+// instead of objects which are later imported from their URL.
+type ImageRegistry interface {
+	Registry
+	// UploadImage creates an image with the given options, uploads size bytes read from reader as image data
+	// and returns the ID of the image.
+	UploadImage(ctx context.Context, createOpts *CreateOpts, reader io.Reader, size int64) (string, error)
+	// UpdateImageProperties adds the properties to the image with the given ID or replaces their values.
+	UpdateImageProperties(ctx context.Context, imageID string, properties map[string]string) error
+}
+
+// ImageImporter is implemented by registries which can import node images from their URL.
+type ImageImporter interface {
+	// ImportImage creates an image with the given options, imports the image data from the URL
+	// and returns the ID of the image once it is active.
+	ImportImage(ctx context.Context, createOpts *CreateOpts, url string) (string, error)
+}
+
+// RegistryFactory creates a Registry based on the registry configuration.
+type RegistryFactory func(ctx context.Context, registryConfig *RegistryConfig) (Registry, error)
+
+var (
+	registryFactoriesMu sync.RWMutex
+	registryFactories   = map[string]RegistryFactory{
+		RegistryTypeS3:     newS3Registry,
+		RegistryTypeSwift:  newSwiftRegistry,
+		RegistryTypeGlance: newGlanceRegistry,
+		RegistryTypeOCI:    newOCIRegistry,
+		RegistryTypeLocal:  newLocalRegistry,
+	}
+)
+
+// RegisterRegistry makes a registry backend available under the given registry type.
+// It overrides a previously registered backend of the same type.
+func RegisterRegistry(registryType string, factory RegistryFactory) {
+	registryFactoriesMu.Lock()
+	defer registryFactoriesMu.Unlock()
+	registryFactories[registryType] = factory
+}
+
+// NewRegistry returns the Registry selected by the type defined in the registry configuration.
+func NewRegistry(ctx context.Context, registryConfig *RegistryConfig) (Registry, error) {
+	registryFactoriesMu.RLock()
+	factory, ok := registryFactories[registryConfig.Type]
+	registryFactoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("error, unsupported registry type %q, supported types are %s", registryConfig.Type, strings.Join(registryTypes(), ", "))
+	}
+	return factory(ctx, registryConfig)
+}
+
+func registryTypes() []string {
+	registryFactoriesMu.RLock()
+	defer registryFactoriesMu.RUnlock()
+
+	types := make([]string, 0, len(registryFactories))
+	for registryType := range registryFactories {
+		types = append(types, registryType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func isRegisteredRegistryType(registryType string) bool {
+	registryFactoriesMu.RLock()
+	defer registryFactoriesMu.RUnlock()
+
+	_, ok := registryFactories[registryType]
+	return ok
+}
+
+// GetRegistryConfig returns the registry configuration.
+func GetRegistryConfig(registryConfigPath string) (*RegistryConfig, error) {
+	// Load registry configuration from YAML file
+	// #nosec G304
+	registryConfigFile, err := os.Open(registryConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening registry config file: %w", err)
+	}
+	defer registryConfigFile.Close()
+
+	var registryConfig RegistryConfig
+	decoder := yaml.NewDecoder(registryConfigFile)
+	if err := decoder.Decode(&registryConfig); err != nil {
+		return nil, fmt.Errorf("error decoding registry config file: %w", err)
+	}
+	if err := registryConfig.resolve(); err != nil {
+		return nil, fmt.Errorf("error resolving registry config file: %w", err)
+	}
+	return &registryConfig, nil
+}
+
+// registryFieldError is an error of a field of the registry configuration.
+type registryFieldError struct {
+	field string
+	err   error
+}
+
+func (e *registryFieldError) Error() string {
+	return fmt.Sprintf("field '%s': %v", e.field, e.err)
+}
+
+func (e *registryFieldError) Unwrap() error {
+	return e.err
+}
+
+// resolve expands the references to environment variables in the fields of the registry configuration and reads
+// the access and secret key from accessKeyFile and secretKeyFile.
+func (c *RegistryConfig) resolve() error {
+	var errs []error
+	for _, fieldErr := range c.resolveFields() {
+		errs = append(errs, fieldErr)
+	}
+	return errors.Join(errs...)
+}
+
+// resolveFields resolves the registry configuration like resolve and returns the errors per field.
+func (c *RegistryConfig) resolveFields() []*registryFieldError {
+	config := &c.Config
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"endpoint", &config.Endpoint},
+		{"bucket", &config.Bucket},
+		{"accessKey", &config.AccessKey},
+		{"secretKey", &config.SecretKey},
+		{"accessKeyFile", &config.AccessKeyFile},
+		{"secretKeyFile", &config.SecretKeyFile},
+		{"cacert", &config.Cacert},
+		{"projectID", &config.ProjectID},
+		{"authURL", &config.AuthURL},
+		{"region", &config.Region},
+		{"directory", &config.Directory},
+		{"baseURL", &config.BaseURL},
+	}
+
+	var errs []*registryFieldError
+	for _, field := range fields {
+		expanded, err := expandEnv(*field.value)
+		if err != nil {
+			errs = append(errs, &registryFieldError{field: field.name, err: err})
+			continue
+		}
+		*field.value = expanded
+	}
+
+	keyFiles := []struct {
+		name string
+		key  *string
+		file string
+	}{
+		{"accessKeyFile", &config.AccessKey, config.AccessKeyFile},
+		{"secretKeyFile", &config.SecretKey, config.SecretKeyFile},
+	}
+	for _, keyFile := range keyFiles {
+		if keyFile.file == "" {
+			continue
+		}
+		if *keyFile.key != "" {
+			errs = append(errs, &registryFieldError{field: keyFile.name, err: fmt.Errorf("must not be defined together with '%s'", strings.TrimSuffix(keyFile.name, "File"))})
+			continue
+		}
+		data, err := os.ReadFile(keyFile.file)
+		if err != nil {
+			errs = append(errs, &registryFieldError{field: keyFile.name, err: err})
+			continue
+		}
+		*keyFile.key = strings.TrimSpace(string(data))
+	}
+	return errs
+}
+
+// expandEnv replaces the references to environment variables like ${AWS_ACCESS_KEY_ID} in the value.
+// It fails if a referenced environment variable is not set.
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envReferenceRegex.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReferenceRegex.FindStringSubmatch(reference)[1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// UploadFile uploads the file as object with the given name to the registry and returns the checksums
+// computed while uploading.
+func UploadFile(ctx context.Context, registry Registry, filePath, objectName string) (*Checksum, error) {
+	return UploadFileWithMetadata(ctx, registry, filePath, objectName, nil)
+}
+
+// UploadFileWithMetadata uploads the file as object with the given name and metadata to the registry and returns
+// the checksums computed while uploading. The metadata is only stored if the registry is a MetadataRegistry.
+func UploadFileWithMetadata(ctx context.Context, registry Registry, filePath, objectName string, metadata map[string]string) (*Checksum, error) {
+	// Open file to upload
+	// #nosec G304
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	// Get file info
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error getting file info: %w", err)
+	}
+
+	reader := newChecksumReader(file)
+	if metadataRegistry, ok := registry.(MetadataRegistry); ok {
+		err = metadataRegistry.UploadWithMetadata(ctx, objectName, reader, fileInfo.Size(), metadata)
+	} else {
+		err = registry.Upload(ctx, objectName, reader, fileInfo.Size())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error uploading file: %w", err)
+	}
+	return uploadChecksum(reader, filePath, fileInfo.Size())
+}
+
+// UploadImageFile uploads the file as image with the given create options to the image registry and returns
+// the image ID and the checksums computed while uploading.
+func UploadImageFile(ctx context.Context, registry ImageRegistry, filePath string, createOpts *CreateOpts) (string, *Checksum, error) {
+	// Open file to upload
+	// #nosec G304
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	// Get file info
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting file info: %w", err)
+	}
+
+	reader := newChecksumReader(file)
+	imageID, err := registry.UploadImage(ctx, createOpts, reader, fileInfo.Size())
+	if err != nil {
+		return "", nil, fmt.Errorf("error uploading file: %w", err)
+	}
+	checksum, err := uploadChecksum(reader, filePath, fileInfo.Size())
+	if err != nil {
+		return "", nil, err
+	}
+	return imageID, checksum, nil
+}
+
+// contextReader is a reader which fails once the context is done, so copying a large image can be interrupted.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// endpointURL returns the registry endpoint including the scheme.
+// Requests are always secure (HTTPS) by default unless `verify: false` is defined in registry.yaml.
+func endpointURL(registryConfig *RegistryConfig) string {
+	endpoint := strings.TrimSuffix(registryConfig.Config.Endpoint, "/")
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		return endpoint
+	}
+	if registryConfig.Config.Verify != nil && !*registryConfig.Config.Verify {
+		return "http://" + endpoint
+	}
+	return "https://" + endpoint
+}
+
+// lowerCaseKeys returns a copy of the map with lower case keys.
+func lowerCaseKeys(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(m))
+	for key, value := range m {
+		result[strings.ToLower(key)] = value
+	}
+	return result
+}
+
+func tlsConfig(registryConfig *RegistryConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if registryConfig.Config.Cacert != "" {
+		config.RootCAs = x509.NewCertPool()
+		data, err := os.ReadFile(registryConfig.Config.Cacert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA certificate: %w", err)
+		}
+		ok := config.RootCAs.AppendCertsFromPEM(data)
+		if !ok {
+			// If no certificates were successfully parsed, set RootCAs to nil
+			config.RootCAs = nil
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("CSCTL_TEST_ENDPOINT", "s3.example.com")
+	t.Setenv("CSCTL_TEST_EMPTY", "")
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr string
+	}{
+		{name: "no reference", value: "s3.example.com", want: "s3.example.com"},
+		{name: "reference", value: "https://${CSCTL_TEST_ENDPOINT}:9000", want: "https://s3.example.com:9000"},
+		{name: "empty variable", value: "${CSCTL_TEST_EMPTY}", want: ""},
+		{name: "unbraced reference is kept", value: "$CSCTL_TEST_ENDPOINT", want: "$CSCTL_TEST_ENDPOINT"},
+		{name: "missing variables", value: "${CSCTL_TEST_MISSING_1}/${CSCTL_TEST_MISSING_2}", wantErr: "environment variable CSCTL_TEST_MISSING_1, CSCTL_TEST_MISSING_2 is not set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandEnv(tt.value)
+			switch {
+			case tt.wantErr != "":
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+			case err != nil:
+				t.Fatalf("expand failed: %v", err)
+			case got != tt.want:
+				t.Errorf("expanded value is %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRegistryConfigCredentials(t *testing.T) {
+	t.Setenv("CSCTL_TEST_ACCESS_KEY", "env-access")
+	t.Setenv("CSCTL_TEST_SECRET_KEY", "env-secret")
+
+	keyDir := t.TempDir()
+	writeFile(t, filepath.Join(keyDir, "access"), "file-access\n", 0o600)
+	writeFile(t, filepath.Join(keyDir, "secret"), "file-secret\n", 0o600)
+
+	tests := []struct {
+		name          string
+		config        string
+		wantAccessKey string
+		wantSecretKey string
+		wantErr       string
+	}{
+		{
+			name:          "environment variables",
+			config:        "accessKey: ${CSCTL_TEST_ACCESS_KEY}\n  secretKey: ${CSCTL_TEST_SECRET_KEY}",
+			wantAccessKey: "env-access",
+			wantSecretKey: "env-secret",
+		},
+		{
+			name:          "key files",
+			config:        "accessKeyFile: KEYDIR/access\n  secretKeyFile: KEYDIR/secret",
+			wantAccessKey: "file-access",
+			wantSecretKey: "file-secret",
+		},
+		{
+			name:          "key file path from environment variable",
+			config:        "accessKey: plain\n  secretKeyFile: ${CSCTL_TEST_KEY_DIR}/secret",
+			wantAccessKey: "plain",
+			wantSecretKey: "file-secret",
+		},
+		{
+			name:    "key and key file",
+			config:  "accessKey: plain\n  accessKeyFile: KEYDIR/access",
+			wantErr: "field 'accessKeyFile': must not be defined together with 'accessKey'",
+		},
+		{
+			name:    "missing key file",
+			config:  "secretKeyFile: KEYDIR/missing",
+			wantErr: "field 'secretKeyFile': open",
+		},
+		{
+			name:    "missing environment variable",
+			config:  "accessKey: ${CSCTL_TEST_MISSING}",
+			wantErr: "field 'accessKey': environment variable CSCTL_TEST_MISSING is not set",
+		},
+	}
+
+	t.Setenv("CSCTL_TEST_KEY_DIR", keyDir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registryConfigPath := filepath.Join(t.TempDir(), "registry.yaml")
+			content := "type: S3\nconfig:\n  endpoint: s3.example.com\n  bucket: images\n  " + strings.ReplaceAll(tt.config, "KEYDIR", keyDir) + "\n"
+			writeFile(t, registryConfigPath, content, 0o600)
+
+			registryConfig, err := GetRegistryConfig(registryConfigPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("get registry config failed: %v", err)
+			}
+			if registryConfig.Config.AccessKey != tt.wantAccessKey || registryConfig.Config.SecretKey != tt.wantSecretKey {
+				t.Errorf("credentials are %q/%q, want %q/%q", registryConfig.Config.AccessKey, registryConfig.Config.SecretKey, tt.wantAccessKey, tt.wantSecretKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Registry is a Registry backed by an S3 compatible object storage.
+type s3Registry struct {
+	client *minio.Client
+	config *RegistryConfig
+}
+
+var _ MetadataRegistry = &s3Registry{}
+
+func newS3Registry(_ context.Context, registryConfig *RegistryConfig) (Registry, error) {
+	// Remove "http://" or "https://" from the endpoint if present cause Endpoint cannot have fully qualified paths in minioClient.
+	endpoint := strings.TrimPrefix(registryConfig.Config.Endpoint, "http://")
+	endpoint = strings.TrimPrefix(endpoint, "https://")
+
+	// Requests are always secure (HTTPS) by default unless `verify: false` is defined in registry.yaml to enable insecure (HTTP) access.
+	useSSL := true
+
+	if registryConfig.Config.Verify != nil {
+		useSSL = *registryConfig.Config.Verify
+	}
+
+	// TLS configuration
+	config, err := tlsConfig(registryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create custom HTTP transport using the TLS configuration
+	customTransport := &http.Transport{
+		TLSClientConfig: config,
+	}
+
+	creds, err := s3Credentials(registryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize Minio client
+	minioClient, err := minio.New(endpoint, &minio.Options{
+		Creds:     creds,
+		Secure:    useSSL,
+		Transport: customTransport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error initializing Minio client: %w", err)
+	}
+
+	return &s3Registry{client: minioClient, config: registryConfig}, nil
+}
+
+// s3Credentials returns the access and secret key defined in registry.yaml. If both are empty, the credentials are
+// taken from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN or MINIO_ROOT_USER and
+// MINIO_ROOT_PASSWORD environment variables, the shared AWS credentials file, the MinIO client config or IAM,
+// whichever provides them first.
+func s3Credentials(registryConfig *RegistryConfig) (*credentials.Credentials, error) {
+	accessKey, secretKey := registryConfig.Config.AccessKey, registryConfig.Config.SecretKey
+	switch {
+	case accessKey != "" && secretKey != "":
+		return credentials.NewStaticV4(accessKey, secretKey, ""), nil
+	case accessKey != "" || secretKey != "":
+		return nil, fmt.Errorf("fields 'accessKey' and 'secretKey' must be defined together")
+	}
+
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.FileMinioClient{},
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+	}), nil
+}
+
+func (r *s3Registry) Upload(ctx context.Context, objectName string, reader io.Reader, size int64) error {
+	return r.UploadWithMetadata(ctx, objectName, reader, size, nil)
+}
+
+// UploadWithMetadata uploads the object and stores the metadata as user metadata (x-amz-meta-*).
+func (r *s3Registry) UploadWithMetadata(ctx context.Context, objectName string, reader io.Reader, size int64, metadata map[string]string) error {
+	_, err := r.client.PutObject(ctx, r.config.Config.Bucket, objectName, reader, size, minio.PutObjectOptions{UserMetadata: metadata})
+	if err != nil {
+		err = fmt.Errorf("error uploading object %s: %w", objectName, err)
+		if ctx.Err() != nil {
+			err = errors.Join(err, r.abortUpload(ctx, objectName))
+		}
+		return err
+	}
+	return nil
+}
+
+// UpdateMetadata stores the metadata in the hidden object .<object>.metadata.json next to the object. S3 cannot
+// change the user metadata of an existing object without copying it, which takes long for large images and fails
+// for objects larger than 5 GiB with CopyObject. The metadata object records the ETag of the object, so it is
+// ignored once the object is replaced.
+func (r *s3Registry) UpdateMetadata(ctx context.Context, objectName string, metadata map[string]string) error {
+	info, err := r.client.StatObject(ctx, r.config.Config.Bucket, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return fmt.Errorf("%s: %w", objectName, ErrObjectNotFound)
+		}
+		return fmt.Errorf("error getting object info of %s: %w", objectName, err)
+	}
+	metadataData, err := json.Marshal(s3Metadata{ETag: info.ETag, Metadata: lowerCaseKeys(metadata)})
+	if err != nil {
+		return fmt.Errorf("error marshaling metadata of object %s: %w", objectName, err)
+	}
+	_, err = r.client.PutObject(ctx, r.config.Config.Bucket, metadataObjectName(objectName), bytes.NewReader(metadataData),
+		int64(len(metadataData)), minio.PutObjectOptions{ContentType: "application/json"})
+	if err != nil {
+		return fmt.Errorf("error updating metadata of object %s: %w", objectName, err)
+	}
+	return nil
+}
+
+// s3Metadata is the content of the metadata object of an object.
+type s3Metadata struct {
+	// ETag is the ETag of the object the metadata belongs to.
+	ETag     string            `json:"etag"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// metadataObjectName returns the name of the object containing the metadata of the object.
+func metadataObjectName(objectName string) string {
+	return path.Join(path.Dir(objectName), "."+path.Base(objectName)+".metadata.json")
+}
+
+// readMetadata returns the metadata of the object with the given ETag from its metadata object, or nil if there is no
+// metadata object or it belongs to a replaced object.
+func (r *s3Registry) readMetadata(ctx context.Context, objectName, etag string) (map[string]string, error) {
+	object, err := r.client.GetObject(ctx, r.config.Config.Bucket, metadataObjectName(objectName), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata of object %s: %w", objectName, err)
+	}
+	defer object.Close()
+
+	metadataData, err := io.ReadAll(object)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading metadata of object %s: %w", objectName, err)
+	}
+	var metadata s3Metadata
+	if err := json.Unmarshal(metadataData, &metadata); err != nil {
+		return nil, fmt.Errorf("error unmarshaling metadata of object %s: %w", objectName, err)
+	}
+	if metadata.ETag != etag {
+		return nil, nil
+	}
+	return metadata.Metadata, nil
+}
+
+// abortUpload removes the parts of an interrupted multipart upload of the object, which would otherwise be kept
+// and billed by the storage provider. minio aborts the upload with the context of the upload, which fails once
+// the context is canceled.
+func (r *s3Registry) abortUpload(ctx context.Context, objectName string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	if err := r.client.RemoveIncompleteUpload(ctx, r.config.Config.Bucket, objectName); err != nil {
+		return fmt.Errorf("error aborting incomplete upload of object %s: %w", objectName, err)
+	}
+	return nil
+}
+
+// Stat returns the object info with the user metadata of the object, which is overridden by the metadata stored by
+// UpdateMetadata.
+func (r *s3Registry) Stat(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	info, err := r.client.StatObject(ctx, r.config.Config.Bucket, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%s: %w", objectName, ErrObjectNotFound)
+		}
+		return nil, fmt.Errorf("error getting object info of %s: %w", objectName, err)
+	}
+	metadata := lowerCaseKeys(info.UserMetadata)
+	updatedMetadata, err := r.readMetadata(ctx, objectName, info.ETag)
+	if err != nil {
+		return nil, err
+	}
+	if updatedMetadata != nil {
+		metadata = updatedMetadata
+	}
+	return &ObjectInfo{
+		Name:         info.Key,
+		Size:         info.Size,
+		LastModified: info.LastModified,
+		Metadata:     metadata,
+	}, nil
+}
+
+func (r *s3Registry) Delete(ctx context.Context, objectName string) error {
+	if err := r.client.RemoveObject(ctx, r.config.Config.Bucket, objectName, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("error deleting object %s: %w", objectName, err)
+	}
+	// Removing a missing object succeeds in S3
+	if err := r.client.RemoveObject(ctx, r.config.Config.Bucket, metadataObjectName(objectName), minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("error deleting metadata of object %s: %w", objectName, err)
+	}
+	return nil
+}
+
+func (r *s3Registry) List(ctx context.Context) ([]ObjectInfo, error) {
+	var objectInfos []ObjectInfo
+	for info := range r.client.ListObjects(ctx, r.config.Config.Bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if info.Err != nil {
+			return nil, fmt.Errorf("error listing objects: %w", info.Err)
+		}
+		// Skip the metadata objects
+		if strings.HasPrefix(path.Base(info.Key), ".") {
+			continue
+		}
+		objectInfos = append(objectInfos, ObjectInfo{
+			Name:         info.Key,
+			Size:         info.Size,
+			LastModified: info.LastModified,
+		})
+	}
+	return objectInfos, nil
+}
+
+// URL returns the object URL in the form of <endpoint>/<bucket>/<object>.
+func (r *s3Registry) URL(_ context.Context, objectName string) (string, error) {
+	return fmt.Sprintf("%s/%s/%s", endpointURL(r.config), r.config.Config.Bucket, objectName), nil
+}
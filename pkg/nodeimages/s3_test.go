@@ -0,0 +1,342 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5" // #nosec G501
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestS3Credentials(t *testing.T) {
+	tests := []struct {
+		name            string
+		accessKey       string
+		secretKey       string
+		env             map[string]string
+		credentialsFile string
+		wantAccessKey   string
+		wantSecretKey   string
+		wantErr         bool
+	}{
+		{
+			name:          "registry config before environment",
+			accessKey:     "config-access",
+			secretKey:     "config-secret",
+			env:           map[string]string{"AWS_ACCESS_KEY_ID": "env-access", "AWS_SECRET_ACCESS_KEY": "env-secret"},
+			wantAccessKey: "config-access",
+			wantSecretKey: "config-secret",
+		},
+		{
+			name:            "AWS environment variables before MinIO and credentials file",
+			env:             map[string]string{"AWS_ACCESS_KEY_ID": "env-access", "AWS_SECRET_ACCESS_KEY": "env-secret", "MINIO_ROOT_USER": "minio-access", "MINIO_ROOT_PASSWORD": "minio-secret"},
+			credentialsFile: "[default]\naws_access_key_id = file-access\naws_secret_access_key = file-secret\n",
+			wantAccessKey:   "env-access",
+			wantSecretKey:   "env-secret",
+		},
+		{
+			name:            "MinIO environment variables before credentials file",
+			env:             map[string]string{"MINIO_ROOT_USER": "minio-access", "MINIO_ROOT_PASSWORD": "minio-secret"},
+			credentialsFile: "[default]\naws_access_key_id = file-access\naws_secret_access_key = file-secret\n",
+			wantAccessKey:   "minio-access",
+			wantSecretKey:   "minio-secret",
+		},
+		{
+			name:            "shared AWS credentials file",
+			credentialsFile: "[default]\naws_access_key_id = file-access\naws_secret_access_key = file-secret\n",
+			wantAccessKey:   "file-access",
+			wantSecretKey:   "file-secret",
+		},
+		{
+			name:      "only access key",
+			accessKey: "config-access",
+			wantErr:   true,
+		},
+		{
+			name:      "only secret key",
+			secretKey: "config-secret",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Keep the credentials of the environment running the tests out of the chain
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "MINIO_ROOT_USER", "MINIO_ROOT_PASSWORD", "MINIO_ACCESS_KEY", "MINIO_SECRET_KEY"} {
+				t.Setenv(name, tt.env[name])
+			}
+			credentialsFile := filepath.Join(home, "credentials")
+			t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+			if tt.credentialsFile != "" {
+				writeFile(t, credentialsFile, tt.credentialsFile, 0o600)
+			}
+
+			registryConfig := &RegistryConfig{Type: RegistryTypeS3}
+			registryConfig.Config.AccessKey = tt.accessKey
+			registryConfig.Config.SecretKey = tt.secretKey
+			creds, err := s3Credentials(registryConfig)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error for incomplete credentials")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getting credentials failed: %v", err)
+			}
+			value, err := creds.Get()
+			if err != nil {
+				t.Fatalf("resolving credentials failed: %v", err)
+			}
+			if value.AccessKeyID != tt.wantAccessKey || value.SecretAccessKey != tt.wantSecretKey {
+				t.Errorf("credentials are %q/%q, want %q/%q", value.AccessKeyID, value.SecretAccessKey, tt.wantAccessKey, tt.wantSecretKey)
+			}
+		})
+	}
+}
+
+// fakeS3 is a minimal S3 API which stores objects with their user metadata, lists one incomplete multipart upload
+// per object and records aborted uploads.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeS3Object
+	aborted []string
+}
+
+type fakeS3Object struct {
+	data     []byte
+	metadata http.Header
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := req.URL.Query()
+	bucket, object, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	switch {
+	case object == "" && query.Has("location"):
+		fmt.Fprint(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+	case object == "" && query.Has("uploads") && req.Method == http.MethodGet:
+		fmt.Fprintf(w, `<ListMultipartUploadsResult><Bucket>%s</Bucket><IsTruncated>false</IsTruncated>`+
+			`<Upload><Key>%s</Key><UploadId>upload-1</UploadId></Upload></ListMultipartUploadsResult>`, bucket, query.Get("prefix"))
+	case object == "" && query.Get("list-type") == "2" && req.Method == http.MethodGet:
+		fmt.Fprintf(w, `<ListBucketResult><Name>%s</Name><IsTruncated>false</IsTruncated>`, bucket)
+		for _, name := range s.objectNames() {
+			fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><LastModified>2024-01-01T00:00:00.000Z</LastModified>`+
+				`<ETag>"%s"</ETag></Contents>`, name, len(s.objects[name].data), fakeS3ETag(s.objects[name].data))
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	case object != "" && query.Has("uploadId") && req.Method == http.MethodDelete:
+		s.aborted = append(s.aborted, object+"/"+query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case object != "" && req.Method == http.MethodPut:
+		data, err := readS3Body(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		metadata := http.Header{}
+		for key, values := range req.Header {
+			if strings.HasPrefix(strings.ToLower(key), "x-amz-meta-") {
+				metadata[key] = values
+			}
+		}
+		if s.objects == nil {
+			s.objects = map[string]*fakeS3Object{}
+		}
+		s.objects[object] = &fakeS3Object{data: data, metadata: metadata}
+		w.Header().Set("ETag", `"`+fakeS3ETag(data)+`"`)
+	case object != "" && (req.Method == http.MethodHead || req.Method == http.MethodGet):
+		stored, ok := s.objects[object]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if req.Method == http.MethodGet {
+				fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>`, object)
+			}
+			return
+		}
+		for key, values := range stored.metadata {
+			w.Header()[key] = values
+		}
+		w.Header().Set("ETag", `"`+fakeS3ETag(stored.data)+`"`)
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(stored.data)))
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(stored.data)
+		}
+	case object != "" && req.Method == http.MethodDelete:
+		delete(s.objects, object)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// objectNames returns the sorted names of the stored objects.
+func (s *fakeS3) objectNames() []string {
+	names := make([]string, 0, len(s.objects))
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fakeS3ETag(data []byte) string {
+	sum := md5.Sum(data) // #nosec G401
+	return hex.EncodeToString(sum[:])
+}
+
+// readS3Body returns the body of the request, which minio sends in the aws-chunked encoding over HTTP.
+func readS3Body(req *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(req.Body)
+	}
+	reader := bufio.NewReader(req.Body)
+	var data []byte
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		// Every chunk ends with CRLF
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func newTestS3Registry(t *testing.T, fake *fakeS3) *s3Registry {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	verify := false
+	registryConfig := &RegistryConfig{Type: RegistryTypeS3}
+	registryConfig.Config.Endpoint = server.URL
+	registryConfig.Config.Bucket = "images"
+	registryConfig.Config.AccessKey = "access"
+	registryConfig.Config.SecretKey = "secret"
+	registryConfig.Config.Verify = &verify
+	registry, err := newS3Registry(context.Background(), registryConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry.(*s3Registry)
+}
+
+func TestS3UploadAbortedOnCancel(t *testing.T) {
+	fake := &fakeS3{}
+	registry := newTestS3Registry(t, fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := registry.Upload(ctx, "ubuntu", strings.NewReader(testImageContent), int64(len(testImageContent)))
+	if err == nil {
+		t.Fatal("expected error uploading with canceled context")
+	}
+
+	// The incomplete upload is aborted, although the context of the upload is canceled
+	if len(fake.aborted) != 1 || fake.aborted[0] != "ubuntu/upload-1" {
+		t.Errorf("aborted uploads are %v, want [ubuntu/upload-1]", fake.aborted)
+	}
+}
+
+func TestS3Metadata(t *testing.T) {
+	fake := &fakeS3{}
+	registry := newTestS3Registry(t, fake)
+	ctx := context.Background()
+
+	if err := registry.UpdateMetadata(ctx, "ubuntu", map[string]string{MetadataInputHash: "hash"}); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("updating metadata of a missing object returned %v, want %v", err, ErrObjectNotFound)
+	}
+
+	uploadMetadata := map[string]string{MetadataInputHash: "upload-hash"}
+	if err := registry.UploadWithMetadata(ctx, "ubuntu", strings.NewReader(testImageContent), int64(len(testImageContent)), uploadMetadata); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	objectInfo, err := registry.Stat(ctx, "ubuntu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := objectInfo.Metadata[MetadataInputHash]; got != "upload-hash" {
+		t.Errorf("input hash after upload is %q, want %q", got, "upload-hash")
+	}
+
+	// The metadata is stored next to the object, which is not copied
+	if err := registry.UpdateMetadata(ctx, "ubuntu", map[string]string{MetadataInputHash: "hash"}); err != nil {
+		t.Fatalf("updating metadata failed: %v", err)
+	}
+	if got := string(fake.objects["ubuntu"].data); got != testImageContent {
+		t.Errorf("object content is %q, want it unchanged", got)
+	}
+	objectInfo, err = registry.Stat(ctx, "ubuntu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := objectInfo.Metadata[MetadataInputHash]; got != "hash" {
+		t.Errorf("input hash after update is %q, want %q", got, "hash")
+	}
+	objectInfos, err := registry.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objectInfos) != 1 || objectInfos[0].Name != "ubuntu" {
+		t.Errorf("listed objects are %v, want only ubuntu", objectInfos)
+	}
+
+	// The metadata of a replaced object is not used for the new object
+	if err := registry.Upload(ctx, "ubuntu", strings.NewReader("other image"), int64(len("other image"))); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	objectInfo, err = registry.Stat(ctx, "ubuntu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objectInfo.Metadata) != 0 {
+		t.Errorf("metadata of replaced object is %v, want none", objectInfo.Metadata)
+	}
+
+	if err := registry.Delete(ctx, "ubuntu"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("objects left after delete: %v", fake.objectNames())
+	}
+}
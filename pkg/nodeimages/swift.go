@@ -0,0 +1,292 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/objectstorage/v1/containers"
+	"github.com/gophercloud/gophercloud/openstack/objectstorage/v1/objects"
+)
+
+// swiftSegmentSize is the size of the segments of a static large object. Swift rejects objects larger than
+// max_file_size, which is 5 GiB by default, so larger images are uploaded in segments.
+const swiftSegmentSize int64 = 1 << 30
+
+// swiftRegistry is a Registry backed by the OpenStack Swift object API.
+type swiftRegistry struct {
+	client *gophercloud.ServiceClient
+	config *RegistryConfig
+	// segmentSize is the size above which objects are uploaded as static large objects.
+	segmentSize int64
+}
+
+// swiftSegment is an entry of the manifest of a static large object.
+type swiftSegment struct {
+	Path      string `json:"path"`
+	ETag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+var _ MetadataRegistry = &swiftRegistry{}
+
+// swiftAccountURL returns the Swift account URL in the form of <endpoint>/swift/v1/AUTH_<project-ID>.
+func swiftAccountURL(registryConfig *RegistryConfig) string {
+	return fmt.Sprintf("%s/swift/v1/AUTH_%s", endpointURL(registryConfig), registryConfig.Config.ProjectID)
+}
+
+// newSwiftRegistry returns a Swift registry. The given context is used for all requests of the registry.
+func newSwiftRegistry(ctx context.Context, registryConfig *RegistryConfig) (Registry, error) {
+	if registryConfig.Config.ProjectID == "" {
+		return nil, fmt.Errorf("field 'projectID' must be defined when registry type is %s", RegistryTypeSwift)
+	}
+
+	providerClient, err := newProviderClient(ctx, registryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &gophercloud.ServiceClient{
+		ProviderClient: providerClient,
+		Endpoint:       swiftAccountURL(registryConfig) + "/",
+		Type:           "object-store",
+	}
+	return &swiftRegistry{client: client, config: registryConfig, segmentSize: swiftSegmentSize}, nil
+}
+
+func (r *swiftRegistry) Upload(ctx context.Context, objectName string, reader io.Reader, size int64) error {
+	return r.UploadWithMetadata(ctx, objectName, reader, size, nil)
+}
+
+// UploadWithMetadata uploads the object and stores the metadata as object metadata (X-Object-Meta-*).
+// Objects larger than the segment size are uploaded as static large object.
+func (r *swiftRegistry) UploadWithMetadata(ctx context.Context, objectName string, reader io.Reader, size int64, metadata map[string]string) error {
+	if size > r.segmentSize {
+		return r.uploadSegmented(ctx, objectName, reader, size, metadata)
+	}
+
+	createOpts := objects.CreateOpts{
+		Content:       reader,
+		ContentLength: size,
+		ContentType:   "application/octet-stream",
+		Metadata:      metadata,
+	}
+	// Avoid that gophercloud reads the whole image into memory to calculate the ETag.
+	if _, ok := reader.(io.ReadSeeker); !ok {
+		createOpts.NoETag = true
+	}
+	if err := objects.Create(withContext(ctx, r.client), r.config.Config.Bucket, objectName, createOpts).Err; err != nil {
+		return fmt.Errorf("error uploading object %s: %w", objectName, err)
+	}
+	return nil
+}
+
+// UpdateMetadata replaces the object metadata. For a static large object, the metadata of its manifest is replaced.
+func (r *swiftRegistry) UpdateMetadata(ctx context.Context, objectName string, metadata map[string]string) error {
+	// Swift replaces all metadata of the object on update
+	updateOpts := objects.UpdateOpts{Metadata: metadata}
+	if err := objects.Update(withContext(ctx, r.client), r.config.Config.Bucket, objectName, updateOpts).Err; err != nil {
+		return fmt.Errorf("error updating metadata of object %s: %w", objectName, err)
+	}
+	return nil
+}
+
+// segmentContainer returns the name of the container in which the segments of static large objects are stored.
+func (r *swiftRegistry) segmentContainer() string {
+	return r.config.Config.Bucket + "_segments"
+}
+
+// uploadSegmented uploads the object in segments to the segment container and creates a static large object
+// manifest, which is stored with the metadata under the object name. The segments of a previous upload of the
+// object are deleted afterwards.
+func (r *swiftRegistry) uploadSegmented(ctx context.Context, objectName string, reader io.Reader, size int64, metadata map[string]string) error {
+	if err := r.createSegmentContainer(ctx); err != nil {
+		return err
+	}
+
+	segmentPrefix := objectName + "/slo/"
+	uploadPrefix := fmt.Sprintf("%s%d/%d/%d/", segmentPrefix, time.Now().UnixNano(), size, r.segmentSize)
+	manifest, err := r.uploadSegments(ctx, uploadPrefix, reader, size)
+	if err != nil {
+		r.deleteSegments(segmentNames(manifest, r.segmentContainer()))
+		return err
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		r.deleteSegments(segmentNames(manifest, r.segmentContainer()))
+		return fmt.Errorf("error creating manifest of object %s: %w", objectName, err)
+	}
+	createOpts := objects.CreateOpts{
+		Content:           bytes.NewReader(data),
+		ContentType:       "application/octet-stream",
+		Metadata:          metadata,
+		MultipartManifest: "put",
+	}
+	if err := objects.Create(withContext(ctx, r.client), r.config.Config.Bucket, objectName, createOpts).Err; err != nil {
+		r.deleteSegments(segmentNames(manifest, r.segmentContainer()))
+		return fmt.Errorf("error uploading manifest of object %s: %w", objectName, err)
+	}
+
+	// The segments of a previous upload are no longer referenced
+	if staleSegments, err := r.listSegments(ctx, segmentPrefix); err == nil {
+		staleSegments = slices.DeleteFunc(staleSegments, func(name string) bool { return strings.HasPrefix(name, uploadPrefix) })
+		r.deleteSegments(staleSegments)
+	}
+	return nil
+}
+
+// uploadSegments uploads size bytes read from reader as segments named after the prefix and returns the manifest of
+// the uploaded segments. On failure, the manifest contains the segments which have already been uploaded.
+func (r *swiftRegistry) uploadSegments(ctx context.Context, prefix string, reader io.Reader, size int64) ([]swiftSegment, error) {
+	var manifest []swiftSegment
+	client := withContext(ctx, r.client)
+	reader = &contextReader{ctx: ctx, reader: reader}
+	for index := 0; int64(index)*r.segmentSize < size; index++ {
+		segmentSize := min(r.segmentSize, size-int64(index)*r.segmentSize)
+		segmentName := fmt.Sprintf("%s%08d", prefix, index)
+		segmentReader := &io.LimitedReader{R: reader, N: segmentSize}
+		createOpts := objects.CreateOpts{
+			Content:       segmentReader,
+			ContentLength: segmentSize,
+			ContentType:   "application/octet-stream",
+			NoETag:        true,
+		}
+		header, err := objects.Create(client, r.segmentContainer(), segmentName, createOpts).Extract()
+		if err != nil {
+			return manifest, fmt.Errorf("error uploading segment %s: %w", segmentName, err)
+		}
+		manifest = append(manifest, swiftSegment{
+			Path:      "/" + r.segmentContainer() + "/" + segmentName,
+			ETag:      header.ETag,
+			SizeBytes: segmentSize,
+		})
+		if segmentReader.N > 0 {
+			// The segment is stored, but the data ended before the given size
+			return manifest, fmt.Errorf("error uploading segment %s: %w", segmentName, io.ErrUnexpectedEOF)
+		}
+	}
+	return manifest, nil
+}
+
+// createSegmentContainer creates the segment container with the read ACL of the bucket, so static large objects can
+// be downloaded like other objects of the bucket.
+func (r *swiftRegistry) createSegmentContainer(ctx context.Context) error {
+	client := withContext(ctx, r.client)
+	result := containers.Get(client, r.config.Config.Bucket, nil)
+	if result.Err != nil {
+		return fmt.Errorf("error getting container %s: %w", r.config.Config.Bucket, result.Err)
+	}
+	createOpts := containers.CreateOpts{ContainerRead: result.Header.Get("X-Container-Read")}
+	if err := containers.Create(client, r.segmentContainer(), createOpts).Err; err != nil {
+		return fmt.Errorf("error creating segment container %s: %w", r.segmentContainer(), err)
+	}
+	return nil
+}
+
+// listSegments returns the names of the objects in the segment container which start with the prefix.
+func (r *swiftRegistry) listSegments(ctx context.Context, prefix string) ([]string, error) {
+	pages, err := objects.List(withContext(ctx, r.client), r.segmentContainer(), objects.ListOpts{Prefix: prefix}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("error listing segments: %w", err)
+	}
+	names, err := objects.ExtractNames(pages)
+	if err != nil {
+		return nil, fmt.Errorf("error listing segments: %w", err)
+	}
+	return names, nil
+}
+
+// deleteSegments deletes the segments from the segment container. Failures are ignored, as the segments are only
+// left behind in the segment container.
+func (r *swiftRegistry) deleteSegments(names []string) {
+	client := cleanupClient(r.client)
+	for _, name := range names {
+		_ = objects.Delete(client, r.segmentContainer(), name, nil).Err
+	}
+}
+
+// segmentNames returns the object names of the segments of the manifest in the segment container.
+func segmentNames(manifest []swiftSegment, segmentContainer string) []string {
+	names := make([]string, 0, len(manifest))
+	for _, segment := range manifest {
+		names = append(names, strings.TrimPrefix(segment.Path, "/"+segmentContainer+"/"))
+	}
+	return names
+}
+
+func (r *swiftRegistry) Stat(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	result := objects.Get(withContext(ctx, r.client), r.config.Config.Bucket, objectName, nil)
+	header, err := result.Extract()
+	if err != nil {
+		if errors.As(err, &gophercloud.ErrDefault404{}) {
+			return nil, fmt.Errorf("%s: %w", objectName, ErrObjectNotFound)
+		}
+		return nil, fmt.Errorf("error getting object info of %s: %w", objectName, err)
+	}
+	metadata, err := result.ExtractMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("error getting object metadata of %s: %w", objectName, err)
+	}
+	return &ObjectInfo{
+		Name:         objectName,
+		Size:         header.ContentLength,
+		LastModified: header.LastModified,
+		Metadata:     lowerCaseKeys(metadata),
+	}, nil
+}
+
+// Delete deletes the object and, if it is a static large object, its segments.
+func (r *swiftRegistry) Delete(ctx context.Context, objectName string) error {
+	deleteOpts := objects.DeleteOpts{MultipartManifest: "delete"}
+	if err := objects.Delete(withContext(ctx, r.client), r.config.Config.Bucket, objectName, deleteOpts).Err; err != nil {
+		return fmt.Errorf("error deleting object %s: %w", objectName, err)
+	}
+	return nil
+}
+
+func (r *swiftRegistry) List(ctx context.Context) ([]ObjectInfo, error) {
+	pages, err := objects.List(withContext(ctx, r.client), r.config.Config.Bucket, objects.ListOpts{Full: true}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects: %w", err)
+	}
+	swiftObjects, err := objects.ExtractInfo(pages)
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects: %w", err)
+	}
+
+	objectInfos := make([]ObjectInfo, 0, len(swiftObjects))
+	for i := range swiftObjects {
+		objectInfos = append(objectInfos, ObjectInfo{
+			Name:         swiftObjects[i].Name,
+			Size:         swiftObjects[i].Bytes,
+			LastModified: swiftObjects[i].LastModified,
+		})
+	}
+	return objectInfos, nil
+}
+
+// URL returns the object URL in the form of <endpoint>/swift/v1/AUTH_<project-ID>/<bucket>/<object>.
+func (r *swiftRegistry) URL(_ context.Context, objectName string) (string, error) {
+	return fmt.Sprintf("%s/%s/%s", swiftAccountURL(r.config), r.config.Config.Bucket, objectName), nil
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"crypto/md5" //nolint:gosec // Swift uses MD5 as ETag
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+// fakeSwift is a minimal Swift object API which stores objects in memory and assembles static large objects.
+type fakeSwift struct {
+	mu         sync.Mutex
+	objects    map[string][]byte
+	metadata   map[string]http.Header
+	containers map[string]string
+}
+
+func newFakeSwift() *fakeSwift {
+	return &fakeSwift{
+		objects:    map[string][]byte{},
+		metadata:   map[string]http.Header{},
+		containers: map[string]string{"bucket": ".r:*"},
+	}
+}
+
+func (s *fakeSwift) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	container, _, isObject := strings.Cut(path, "/")
+	if !isObject {
+		s.serveContainer(w, req, container)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		if req.URL.Query().Get("multipart-manifest") == "put" {
+			var manifest []swiftSegment
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var assembled []byte
+			for _, segment := range manifest {
+				assembled = append(assembled, s.objects[strings.TrimPrefix(segment.Path, "/")]...)
+			}
+			data = assembled
+		}
+		s.objects[path] = data
+		s.metadata[path] = req.Header.Clone()
+		sum := md5.Sum(data) //nolint:gosec // Swift uses MD5 as ETag
+		w.Header().Set("ETag", hex.EncodeToString(sum[:]))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodPost:
+		if _, ok := s.objects[path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.metadata[path] = req.Header.Clone()
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		if _, ok := s.objects[path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeSwift) serveContainer(w http.ResponseWriter, req *http.Request, container string) {
+	switch req.Method {
+	case http.MethodPut:
+		s.containers[container] = req.Header.Get("X-Container-Read")
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodHead:
+		read, ok := s.containers[container]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Container-Read", read)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		prefix := container + "/" + req.URL.Query().Get("prefix")
+		marker := container + "/" + req.URL.Query().Get("marker")
+		var names []string
+		for name := range s.objects {
+			if strings.HasPrefix(name, prefix) && name > marker {
+				names = append(names, strings.TrimPrefix(name, container+"/"))
+			}
+		}
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "text/plain")
+		if len(names) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = io.WriteString(w, strings.Join(names, "\n")+"\n")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeSwift) names(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func newTestSwiftRegistry(t *testing.T, server *httptest.Server, segmentSize int64) *swiftRegistry {
+	t.Helper()
+	registryConfig := &RegistryConfig{Type: RegistryTypeSwift}
+	registryConfig.Config.Bucket = "bucket"
+	return &swiftRegistry{
+		client: &gophercloud.ServiceClient{
+			ProviderClient: &gophercloud.ProviderClient{HTTPClient: *server.Client()},
+			Endpoint:       server.URL + "/",
+		},
+		config:      registryConfig,
+		segmentSize: segmentSize,
+	}
+}
+
+func TestSwiftUploadSegmented(t *testing.T) {
+	fake := newFakeSwift()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	registry := newTestSwiftRegistry(t, server, 4)
+
+	content := "0123456789"
+	metadata := map[string]string{MetadataInputHash: "abc"}
+	if err := registry.UploadWithMetadata(context.Background(), "image", strings.NewReader(content), int64(len(content)), metadata); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if got := string(fake.objects["bucket/image"]); got != content {
+		t.Errorf("object content is %q, want %q", got, content)
+	}
+	if got := fake.metadata["bucket/image"].Get("X-Object-Meta-" + MetadataInputHash); got != "abc" {
+		t.Errorf("metadata of manifest is %q, want %q", got, "abc")
+	}
+	if got := fake.containers["bucket_segments"]; got != ".r:*" {
+		t.Errorf("read ACL of segment container is %q, want %q", got, ".r:*")
+	}
+	if segments := fake.names("bucket_segments/image/slo/"); len(segments) != 3 {
+		t.Errorf("got %d segments, want 3: %v", len(segments), segments)
+	}
+
+	// A new upload replaces the segments of the previous one
+	if err := registry.UploadWithMetadata(context.Background(), "image", strings.NewReader(content), int64(len(content)), metadata); err != nil {
+		t.Fatalf("second upload failed: %v", err)
+	}
+	if segments := fake.names("bucket_segments/image/slo/"); len(segments) != 3 {
+		t.Errorf("got %d segments after second upload, want 3: %v", len(segments), segments)
+	}
+}
+
+func TestSwiftUploadSmallObject(t *testing.T) {
+	fake := newFakeSwift()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	registry := newTestSwiftRegistry(t, server, 1<<20)
+
+	content := "small image"
+	if err := registry.Upload(context.Background(), "image", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if got := string(fake.objects["bucket/image"]); got != content {
+		t.Errorf("object content is %q, want %q", got, content)
+	}
+	if segments := fake.names("bucket_segments/"); len(segments) != 0 {
+		t.Errorf("got segments %v for small object", segments)
+	}
+}
+
+func TestSwiftUploadSegmentedCleansUpOnFailure(t *testing.T) {
+	fake := newFakeSwift()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	registry := newTestSwiftRegistry(t, server, 4)
+
+	// The reader ends before the announced size, so the last segment fails
+	content := "0123456789"
+	err := registry.Upload(context.Background(), "image", strings.NewReader(content), int64(len(content))+8)
+	if err == nil {
+		t.Fatal("expected upload to fail")
+	}
+	if segments := fake.names("bucket_segments/"); len(segments) != 0 {
+		t.Errorf("segments %v were not deleted", segments)
+	}
+	if _, ok := fake.objects["bucket/image"]; ok {
+		t.Error("manifest was created although the upload failed")
+	}
+}
+
+func TestSwiftUpdateMetadata(t *testing.T) {
+	fake := newFakeSwift()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	registry := newTestSwiftRegistry(t, server, 1<<20)
+
+	content := "small image"
+	if err := registry.UploadWithMetadata(context.Background(), "image", strings.NewReader(content), int64(len(content)), map[string]string{"stale": "true"}); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if err := registry.UpdateMetadata(context.Background(), "image", map[string]string{MetadataInputHash: "abc"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	header := fake.metadata["bucket/image"]
+	if got := header.Get("X-Object-Meta-" + MetadataInputHash); got != "abc" {
+		t.Errorf("metadata %s is %q, want %q", MetadataInputHash, got, "abc")
+	}
+	if got := header.Get("X-Object-Meta-Stale"); got != "" {
+		t.Errorf("metadata stale is %q, want it to be replaced", got)
+	}
+	if got := string(fake.objects["bucket/image"]); got != content {
+		t.Errorf("object content is %q, want %q", got, content)
+	}
+
+	if err := registry.UpdateMetadata(context.Background(), "missing", map[string]string{MetadataInputHash: "abc"}); err == nil {
+		t.Error("expected error updating metadata of missing object")
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	csctlclusterstack "github.com/SovereignCloudStack/csctl/pkg/clusterstack"
+)
+
+// TemplateData contains the values which can be used as Go template placeholders in the url, createOpts.name and
+// createOpts.tags of the node images in config.yaml, e.g. {{ .KubernetesVersion }}.
+type TemplateData struct {
+	// KubernetesVersion is the Kubernetes version defined in csctl.yaml, e.g. v1.27.8.
+	KubernetesVersion string
+	// KubernetesMinor is the minor version of KubernetesVersion, e.g. v1.27.
+	KubernetesMinor string
+	// ClusterStackName is the cluster stack name defined in csctl.yaml, e.g. ferrol.
+	ClusterStackName string
+	// ReleaseName is the name of the cluster stack release directory.
+	ReleaseName string
+	// ImageDir is the image directory of the node image.
+	ImageDir string
+	// Registry contains the fields of registry.yaml. Credentials are not available.
+	Registry RegistryTemplateData
+}
+
+// RegistryTemplateData contains the fields of registry.yaml which can be used in templates.
+type RegistryTemplateData struct {
+	Type      string
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Directory string
+	BaseURL   string
+}
+
+// NewTemplateData returns the template data of the cluster stack release. The registry config is optional.
+func NewTemplateData(csctlConfig *csctlclusterstack.CsctlConfig, releaseDir string, registryConfig *RegistryConfig) *TemplateData {
+	data := &TemplateData{
+		KubernetesVersion: csctlConfig.Config.KubernetesVersion,
+		KubernetesMinor:   kubernetesMinor(csctlConfig.Config.KubernetesVersion),
+		ClusterStackName:  csctlConfig.Config.ClusterStackName,
+	}
+	if releaseDir != "" {
+		data.ReleaseName = filepath.Base(filepath.Clean(releaseDir))
+	}
+	if registryConfig != nil {
+		data.Registry = RegistryTemplateData{
+			Type:      registryConfig.Type,
+			Endpoint:  registryConfig.Config.Endpoint,
+			Bucket:    registryConfig.Config.Bucket,
+			Region:    registryConfig.Config.Region,
+			Directory: registryConfig.Config.Directory,
+			BaseURL:   registryConfig.Config.BaseURL,
+		}
+	}
+	return data
+}
+
+// kubernetesMinor returns the major and minor part of the Kubernetes version, e.g. v1.27 for v1.27.8.
+func kubernetesMinor(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// RenderTemplates renders the templates in the url, createOpts.name and createOpts.tags of all node images.
+func RenderTemplates(nodeImages *NodeImages, data *TemplateData) error {
+	var errs []error
+	for i, image := range nodeImages.OpenStackNodeImages {
+		if image == nil {
+			continue
+		}
+		if err := data.render(i, image); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CheckRendered returns an error if the url, createOpts.name or createOpts.tags of a node image still contain
+// templates, e.g. because the node images were read from config.yaml instead of the generated node-images.yaml.
+func CheckRendered(nodeImages *NodeImages) error {
+	var errs []error
+	for i, image := range nodeImages.OpenStackNodeImages {
+		if image == nil {
+			continue
+		}
+		for _, field := range templateFields(image) {
+			if isTemplate(*field.text) {
+				errs = append(errs, fmt.Errorf("node image %d: field %s contains the unrendered template %q", i, field.name, *field.text))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// templateField is a field of a node image which can contain a template.
+type templateField struct {
+	name string
+	text *string
+}
+
+// templateFields returns the fields of the node image which can contain templates.
+func templateFields(image *OpenStackNodeImage) []templateField {
+	fields := []templateField{{name: "url", text: &image.URL}}
+	if image.CreateOpts != nil {
+		fields = append(fields, templateField{name: "createOpts.name", text: &image.CreateOpts.Name})
+		for i := range image.CreateOpts.Tags {
+			fields = append(fields, templateField{name: fmt.Sprintf("createOpts.tags[%d]", i), text: &image.CreateOpts.Tags[i]})
+		}
+	}
+	return fields
+}
+
+// render renders the templates of the node image at the given position with the image directory of the node image.
+func (d TemplateData) render(imageOrder int, image *OpenStackNodeImage) error {
+	d.ImageDir = image.ImageDir
+
+	var errs []error
+	for _, field := range templateFields(image) {
+		rendered, err := renderTemplate(field.name, *field.text, &d)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("node image %d: %w", imageOrder, err))
+			continue
+		}
+		*field.text = rendered
+	}
+	return errors.Join(errs...)
+}
+
+// isTemplate reports whether the text contains a template placeholder.
+func isTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
+// renderTemplate renders the Go template text of the field with the data. Text without placeholders is returned
+// unchanged.
+func renderTemplate(field, text string, data *TemplateData) (string, error) {
+	if !isTemplate(text) {
+		return text, nil
+	}
+	tmpl, err := template.New(field).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template: %w", err)
+	}
+	var builder strings.Builder
+	if err := tmpl.Execute(&builder, data); err != nil {
+		return "", fmt.Errorf("error rendering template: %w", err)
+	}
+	return builder.String(), nil
+}
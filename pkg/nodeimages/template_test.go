@@ -0,0 +1,102 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTemplateConfig = `apiVersion: v1
+openStackNodeImages:
+  - url: https://example.com/{{ .ImageDir }}.qcow2
+    imageDir: ubuntu
+    createOpts:
+      name: NAME
+      disk_format: qcow2
+      container_format: bare
+      tags:
+        - TAG
+  - url: https://example.com/flatcar.qcow2
+    createOpts:
+      name: flatcar
+      disk_format: qcow2
+      container_format: bare
+`
+
+func TestValidateRenderedConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		imgName string
+		tag     string
+		wantErr string
+	}{
+		{name: "valid", imgName: "ubuntu-{{ .KubernetesVersion }}", tag: "{{ .ClusterStackName }}"},
+		{name: "name with slash", imgName: "{{ .ImageDir }}/{{ .KubernetesVersion }}", tag: "kube"},
+		{name: "tag with slash", imgName: "ubuntu", tag: "{{ .ClusterStackName }}/{{ .KubernetesMinor }}", wantErr: `tag "ferrol/v1.30" must not contain '/'`},
+		{name: "duplicate name", imgName: `{{ "flatcar" }}`, tag: "kube"},
+		{name: "name too long", imgName: strings.Repeat("{{ .KubernetesVersion }}", 40), tag: "kube", wantErr: "must not be longer than 255 characters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			content := strings.NewReplacer("NAME", `"`+strings.ReplaceAll(tt.imgName, `"`, `\"`)+`"`, "TAG", `"`+tt.tag+`"`).Replace(testTemplateConfig)
+			if err := os.WriteFile(configPath, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			// The templates are only validated once they are rendered
+			nodeImages, err := GetConfig(configPath)
+			if err != nil {
+				t.Fatalf("get config failed: %v", err)
+			}
+			data := &TemplateData{KubernetesVersion: "v1.30.2", KubernetesMinor: "v1.30", ClusterStackName: "ferrol"}
+			if err := RenderTemplates(nodeImages, data); err != nil {
+				t.Fatalf("render failed: %v", err)
+			}
+
+			err = ValidateRenderedConfig(configPath, nodeImages)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validation failed: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validation returned %v, want %q", err, tt.wantErr)
+			case tt.wantErr != "" && !errors.Is(err, ErrConfigInvalid):
+				t.Errorf("error %v is not ErrConfigInvalid", err)
+			}
+		})
+	}
+}
+
+func TestCheckRendered(t *testing.T) {
+	nodeImages := &NodeImages{OpenStackNodeImages: []*OpenStackNodeImage{
+		{URL: "https://example.com/ubuntu.qcow2", CreateOpts: &CreateOpts{Name: "ubuntu"}},
+		{URL: "https://example.com/flatcar.qcow2", CreateOpts: &CreateOpts{Name: "flatcar-{{ .KubernetesVersion }}"}},
+	}}
+	err := CheckRendered(nodeImages)
+	if err == nil || !strings.Contains(err.Error(), `node image 1: field createOpts.name contains the unrendered template`) {
+		t.Fatalf("check returned %v, want unrendered template error", err)
+	}
+
+	if err := RenderTemplates(nodeImages, &TemplateData{KubernetesVersion: "v1.30.2"}); err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	if err := CheckRendered(nodeImages); err != nil {
+		t.Errorf("check of rendered node images failed: %v", err)
+	}
+}
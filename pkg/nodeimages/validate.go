@@ -0,0 +1,528 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	csctlclusterstack "github.com/SovereignCloudStack/csctl/pkg/clusterstack"
+	yaml "github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+	"github.com/goccy/go-yaml/token"
+)
+
+// yamlErrorPositionRegex matches the position prefix of a formatted goccy/go-yaml error, e.g. "[6:7] unknown field".
+var yamlErrorPositionRegex = regexp.MustCompile(`^\[(\d+):(\d+)\] ([^\n]*)`)
+
+// kubernetesVersionRegex matches the Kubernetes version in csctl.yaml.
+var kubernetesVersionRegex = regexp.MustCompile(`^v\d+\.\d+\.\d+$`)
+
+// registryRequiredFields contains the fields which have to be defined in registry.yaml per registry type.
+var registryRequiredFields = map[string][]string{
+	RegistryTypeS3:     {"endpoint", "bucket"},
+	RegistryTypeSwift:  {"endpoint", "bucket", "projectID"},
+	RegistryTypeGlance: {},
+	RegistryTypeOCI:    {"endpoint", "bucket"},
+	RegistryTypeLocal:  {"directory", "baseURL"},
+}
+
+// Problem describes a problem found in a configuration file.
+type Problem struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+// String returns the problem in the form of <file>:<line>:<column>: <message>.
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, p.Message)
+}
+
+// ValidationError contains all problems found in the configuration files.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, 0, len(e.Problems))
+	for _, problem := range e.Problems {
+		problems = append(problems, problem.String())
+	}
+	return fmt.Sprintf("found %d problem(s):\n%s", len(e.Problems), strings.Join(problems, "\n"))
+}
+
+// Unwrap returns ErrConfigInvalid, so validation errors can be checked with errors.Is.
+func (*ValidationError) Unwrap() error {
+	return ErrConfigInvalid
+}
+
+// yamlSource is a parsed YAML file used to look up the positions of problems.
+type yamlSource struct {
+	path string
+	file *ast.File
+}
+
+// newYAMLSource parses the YAML data. If the data cannot be parsed, problems are reported without position.
+func newYAMLSource(path string, data []byte) *yamlSource {
+	file, err := parser.ParseBytes(data, 0)
+	if err != nil {
+		file = nil
+	}
+	return &yamlSource{path: path, file: file}
+}
+
+// position returns the position of the node at the YAML path, e.g. $.openStackNodeImages[0].createOpts.name.
+// If the node does not exist, the position of the closest existing parent node is returned.
+func (s *yamlSource) position(yamlPath string) (line, column int) {
+	if s.file == nil {
+		return 0, 0
+	}
+	for yamlPath != "" && yamlPath != "$" {
+		if path, err := yaml.PathString(yamlPath); err == nil {
+			if node, err := path.FilterFile(s.file); err == nil && node != nil {
+				position := nodePosition(node)
+				return position.Line, position.Column
+			}
+		}
+		yamlPath = yamlPath[:strings.LastIndexAny(yamlPath, ".[")]
+	}
+	return 0, 0
+}
+
+// nodePosition returns the position of the node. For mappings, the position of the first key is used
+// instead of the position of the ':' token.
+func nodePosition(node ast.Node) *token.Position {
+	switch n := node.(type) {
+	case *ast.MappingNode:
+		if len(n.Values) > 0 {
+			return n.Values[0].Key.GetToken().Position
+		}
+	case *ast.MappingValueNode:
+		return n.Key.GetToken().Position
+	}
+	return node.GetToken().Position
+}
+
+// validator collects problems of configuration files.
+type validator struct {
+	problems []Problem
+	// warnings are problems which do not prevent creating node images, e.g. unknown fields.
+	warnings []Problem
+}
+
+// addf adds a problem at the node of the YAML path.
+func (v *validator) addf(source *yamlSource, yamlPath, format string, args ...interface{}) {
+	line, column := source.position(yamlPath)
+	v.problems = append(v.problems, Problem{
+		File:    source.path,
+		Line:    line,
+		Column:  column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// err returns a ValidationError if problems were found.
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+// addYAMLError adds a problem for an error returned by goccy/go-yaml, using the position contained in the error.
+func (v *validator) addYAMLError(source *yamlSource, prefix string, err error) {
+	v.problems = append(v.problems, yamlErrorProblem(source, prefix, err))
+}
+
+// yamlErrorProblem returns the problem of an error returned by goccy/go-yaml, using the position contained in
+// the error.
+func yamlErrorProblem(source *yamlSource, prefix string, err error) Problem {
+	message := yaml.FormatError(err, false, false)
+	matches := yamlErrorPositionRegex.FindStringSubmatch(message)
+	if matches == nil {
+		line, column := source.position("$")
+		return Problem{File: source.path, Line: line, Column: column, Message: prefix + message}
+	}
+	line, _ := strconv.Atoi(matches[1])
+	column, _ := strconv.Atoi(matches[2])
+	return Problem{File: source.path, Line: line, Column: column, Message: prefix + matches[3]}
+}
+
+// decodeStrict decodes the YAML data and reports decoding errors as problems. Unknown fields are reported as
+// warnings, as they are kept in node-images.yaml and ignored in registry.yaml.
+// It returns false if the data could not be decoded at all.
+func (v *validator) decodeStrict(source *yamlSource, data []byte, out interface{}) bool {
+	if err := yaml.Unmarshal(data, out); err != nil {
+		v.addYAMLError(source, "failed to unmarshal yaml: ", err)
+		return false
+	}
+	if source.file != nil {
+		for _, doc := range source.file.Docs {
+			v.addUnknownFields(source, doc.Body, reflect.TypeOf(out))
+		}
+	}
+	return true
+}
+
+// addUnknownFields walks the YAML node along the type it is decoded into and reports every mapping key which does
+// not match a field of a struct as warning at the position of the key.
+func (v *validator) addUnknownFields(source *yamlSource, node ast.Node, typ reflect.Type) {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch n := node.(type) {
+	case *ast.TagNode:
+		v.addUnknownFields(source, n.Value, typ)
+	case *ast.AnchorNode:
+		v.addUnknownFields(source, n.Value, typ)
+	case *ast.MappingNode:
+		for _, value := range n.Values {
+			v.addUnknownFields(source, value, typ)
+		}
+	case *ast.MappingValueNode:
+		switch typ.Kind() {
+		case reflect.Struct:
+			key := n.Key.GetToken().Value
+			if key == "<<" {
+				return
+			}
+			fieldType, ok := yamlFieldType(typ, key)
+			if !ok {
+				position := n.Key.GetToken().Position
+				v.warnings = append(v.warnings, Problem{
+					File:    source.path,
+					Line:    position.Line,
+					Column:  position.Column,
+					Message: fmt.Sprintf("unknown field %q", key),
+				})
+				return
+			}
+			v.addUnknownFields(source, n.Value, fieldType)
+		case reflect.Map:
+			v.addUnknownFields(source, n.Value, typ.Elem())
+		}
+	case *ast.SequenceNode:
+		if typ.Kind() != reflect.Slice && typ.Kind() != reflect.Array {
+			return
+		}
+		for _, value := range n.Values {
+			v.addUnknownFields(source, value, typ.Elem())
+		}
+	}
+}
+
+// yamlFieldType returns the type of the struct field which is decoded from the mapping key, using the same field
+// names as goccy/go-yaml: the yaml tag, the json tag or the lower case field name.
+func yamlFieldType(structType reflect.Type, key string) (reflect.Type, bool) {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get("yaml")
+		if tag == "" {
+			tag = field.Tag.Get("json")
+		}
+		if tag == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if slices.Contains(strings.Split(options, ","), "inline") {
+			inlineType := field.Type
+			if inlineType.Kind() == reflect.Pointer {
+				inlineType = inlineType.Elem()
+			}
+			if inlineType.Kind() == reflect.Struct {
+				if fieldType, ok := yamlFieldType(inlineType, key); ok {
+					return fieldType, true
+				}
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if name == key {
+			return field.Type, true
+		}
+	}
+	return nil, false
+}
+
+// validateNodeImages validates the content of a config.yaml or node-images.yaml file.
+func (v *validator) validateNodeImages(source *yamlSource, nodeImages *NodeImages) {
+	if nodeImages.APIVersion == "" {
+		v.addf(source, "$.apiVersion", "api version must not be empty")
+	}
+
+	if len(nodeImages.OpenStackNodeImages) == 0 {
+		v.addf(source, "$.openStackNodeImages", "at least one node image needs to exist in OpenStackNodeImages list")
+	}
+
+	// Ensure all fields in OpenStackNodeImages are defined
+	for i, image := range nodeImages.OpenStackNodeImages {
+		imagePath := fmt.Sprintf("$.openStackNodeImages[%d]", i)
+		if image == nil {
+			v.addf(source, imagePath, "node image must not be empty")
+			continue
+		}
+		if image.CreateOpts == nil {
+			v.addf(source, imagePath+".createOpts", "field CreateOpts must not be empty")
+			continue
+		}
+		if image.CreateOpts.Name == "" {
+			v.addf(source, imagePath+".createOpts.name", "field 'name' in CreateOpts must be defined")
+		}
+		if image.CreateOpts.DiskFormat == "" {
+			v.addf(source, imagePath+".createOpts.disk_format", "field 'disk_format' in CreateOpts must be defined")
+		}
+		if image.CreateOpts.ContainerFormat == "" {
+			v.addf(source, imagePath+".createOpts.container_format", "field 'container_format' in CreateOpts must be defined")
+		}
+		v.validateCreateOpts(source, imagePath+".createOpts", image.CreateOpts)
+	}
+}
+
+// validateCsctlConfig validates the OpenStack provider configuration in csctl.yaml and returns the method and,
+// if csctl.yaml could be read, the template data of config.yaml.
+func (v *validator) validateCsctlConfig(clusterStackPath string) (string, *TemplateData) {
+	csctlConfigPath := filepath.Join(clusterStackPath, "csctl.yaml")
+	data, err := os.ReadFile(filepath.Clean(csctlConfigPath))
+	if err != nil {
+		v.problems = append(v.problems, Problem{File: csctlConfigPath, Message: fmt.Sprintf("failed to read csctl config: %v", err)})
+		return "", nil
+	}
+	source := newYAMLSource(csctlConfigPath, data)
+
+	var csctlConfig csctlclusterstack.CsctlConfig
+	if err := yaml.Unmarshal(data, &csctlConfig); err != nil {
+		v.addYAMLError(source, "failed to unmarshal csctl yaml: ", err)
+		return "", nil
+	}
+
+	if csctlConfig.Config.ClusterStackName == "" {
+		v.addf(source, "$.config.clusterStackName", "cluster stack name must not be empty")
+	}
+	if !kubernetesVersionRegex.MatchString(csctlConfig.Config.KubernetesVersion) {
+		v.addf(source, "$.config.kubernetesVersion", "invalid kubernetes version: %q", csctlConfig.Config.KubernetesVersion)
+	}
+	if csctlConfig.Config.Provider.Type != Provider {
+		v.addf(source, "$.config.provider.type", "%s: expected %q, got %q", ErrWrongProvider, Provider, csctlConfig.Config.Provider.Type)
+	}
+
+	method, _ := csctlConfig.Config.Provider.Config["method"].(string)
+	switch method {
+	case MethodGet, MethodBuild, MethodMirror:
+	default:
+		v.addf(source, "$.config.provider.config.method", "unknown method %q, expected %q, %q or %q", method, MethodGet, MethodBuild, MethodMirror)
+	}
+	return method, NewTemplateData(&csctlConfig, "", nil)
+}
+
+// validateConfig validates config.yaml of the cluster stack including the image directories required by the method
+// and, if templateData is set, the templates of the node images.
+func (v *validator) validateConfig(clusterStackPath, method string, templateData *TemplateData) {
+	configPath := filepath.Join(clusterStackPath, "node-images", "config.yaml")
+	data, err := os.ReadFile(filepath.Clean(configPath))
+	if err != nil {
+		v.problems = append(v.problems, Problem{File: configPath, Message: fmt.Sprintf("failed to read config file: %v", err)})
+		return
+	}
+	source := newYAMLSource(configPath, data)
+
+	var nodeImages NodeImages
+	if !v.decodeStrict(source, data, &nodeImages) {
+		return
+	}
+	v.validateNodeImages(source, &nodeImages)
+	if method == MethodMirror {
+		v.validateMirrorNames(source, &nodeImages)
+	}
+	if templateData != nil {
+		v.validateTemplates(source, &nodeImages, templateData)
+		var rendered NodeImages
+		if err := yaml.Unmarshal(data, &rendered); err == nil && RenderTemplates(&rendered, templateData) == nil {
+			v.validateRenderedNodeImages(source, method, &rendered)
+		}
+	}
+
+	if method == MethodMirror {
+		for i, image := range nodeImages.OpenStackNodeImages {
+			if image != nil && image.URL == "" {
+				v.addf(source, fmt.Sprintf("$.openStackNodeImages[%d].url", i), "field 'url' must be defined when using the %s method", MethodMirror)
+			}
+		}
+	}
+	if method != MethodBuild {
+		return
+	}
+	for i, image := range nodeImages.OpenStackNodeImages {
+		if image == nil {
+			continue
+		}
+		imageDirPath := fmt.Sprintf("$.openStackNodeImages[%d].imageDir", i)
+		if image.ImageDir == "" {
+			v.addf(source, imageDirPath, "field 'imageDir' must be defined when using the %s method", MethodBuild)
+			continue
+		}
+		packerImagePath := filepath.Join(clusterStackPath, "node-images", image.ImageDir)
+		if fileInfo, err := os.Stat(packerImagePath); err != nil || !fileInfo.IsDir() {
+			v.addf(source, imageDirPath, "image folder %s does not exist", packerImagePath)
+		}
+	}
+}
+
+// validateRenderedNodeImages validates the node images again after their templates were rendered. Problems which do
+// not depend on the templates are already reported and are skipped.
+func (v *validator) validateRenderedNodeImages(source *yamlSource, method string, nodeImages *NodeImages) {
+	rendered := &validator{}
+	rendered.validateNodeImages(source, nodeImages)
+	if method == MethodMirror {
+		rendered.validateMirrorNames(source, nodeImages)
+	}
+	for _, problem := range rendered.problems {
+		if !slices.Contains(v.problems, problem) {
+			v.problems = append(v.problems, problem)
+		}
+	}
+}
+
+// validateMirrorNames validates the names of the node images, which the mirror method uses as object names in the
+// registry. Templates in the names are skipped, they are validated once they are rendered.
+func (v *validator) validateMirrorNames(source *yamlSource, nodeImages *NodeImages) {
+	names := make(map[string]bool, len(nodeImages.OpenStackNodeImages))
+	for i, image := range nodeImages.OpenStackNodeImages {
+		if image == nil || image.CreateOpts == nil || image.CreateOpts.Name == "" || isTemplate(image.CreateOpts.Name) {
+			continue
+		}
+		namePath := fmt.Sprintf("$.openStackNodeImages[%d].createOpts.name", i)
+		if err := checkMirrorName(image.CreateOpts.Name, names); err != nil {
+			v.addf(source, namePath, "%v", err)
+		}
+	}
+}
+
+// validateTemplates reports the templates in config.yaml which cannot be rendered.
+func (v *validator) validateTemplates(source *yamlSource, nodeImages *NodeImages, templateData *TemplateData) {
+	for i, image := range nodeImages.OpenStackNodeImages {
+		if image == nil {
+			continue
+		}
+		data := *templateData
+		data.ImageDir = image.ImageDir
+
+		imagePath := fmt.Sprintf("$.openStackNodeImages[%d]", i)
+		v.validateTemplate(source, imagePath, "url", image.URL, &data)
+		if image.CreateOpts == nil {
+			continue
+		}
+		v.validateTemplate(source, imagePath, "createOpts.name", image.CreateOpts.Name, &data)
+		for j, tag := range image.CreateOpts.Tags {
+			v.validateTemplate(source, imagePath, fmt.Sprintf("createOpts.tags[%d]", j), tag, &data)
+		}
+	}
+}
+
+func (v *validator) validateTemplate(source *yamlSource, imagePath, field, text string, data *TemplateData) {
+	if _, err := renderTemplate(field, text, data); err != nil {
+		v.addf(source, imagePath+"."+field, "%v", err)
+	}
+}
+
+// validateRegistryConfig validates that registry.yaml contains all fields required by the registry type.
+func (v *validator) validateRegistryConfig(registryConfigPath string) {
+	data, err := os.ReadFile(filepath.Clean(registryConfigPath))
+	if err != nil {
+		v.problems = append(v.problems, Problem{File: registryConfigPath, Message: fmt.Sprintf("error reading registry config file: %v", err)})
+		return
+	}
+	source := newYAMLSource(registryConfigPath, data)
+
+	var registryConfig RegistryConfig
+	if !v.decodeStrict(source, data, &registryConfig) {
+		return
+	}
+
+	for _, fieldErr := range registryConfig.resolveFields() {
+		v.addf(source, "$.config."+fieldErr.field, "%v", fieldErr.err)
+	}
+
+	if !isRegisteredRegistryType(registryConfig.Type) {
+		v.addf(source, "$.type", "unsupported registry type %q, supported types are %s", registryConfig.Type, strings.Join(registryTypes(), ", "))
+		return
+	}
+
+	fields := registryConfigFields(&registryConfig)
+	for _, field := range registryRequiredFields[registryConfig.Type] {
+		if fields[field] == "" {
+			v.addf(source, "$.config."+field, "field '%s' must be defined when registry type is %s", field, registryConfig.Type)
+		}
+	}
+
+	if registryConfig.Type == RegistryTypeS3 && (registryConfig.Config.AccessKey == "") != (registryConfig.Config.SecretKey == "") {
+		v.addf(source, "$.config", "fields 'accessKey' and 'secretKey' must be defined together")
+	}
+	if registryConfig.Config.AuthURL != "" && (registryConfig.Config.AccessKey == "" || registryConfig.Config.SecretKey == "") {
+		v.addf(source, "$.config.authURL", "fields 'accessKey' and 'secretKey' must be defined when 'authURL' is set")
+	}
+	if registryConfig.Config.Cacert != "" {
+		if _, err := os.Stat(registryConfig.Config.Cacert); err != nil {
+			v.addf(source, "$.config.cacert", "failed to read the CA certificate: %v", err)
+		}
+	}
+}
+
+// registryConfigFields returns the string fields of the registry configuration by their YAML name.
+func registryConfigFields(registryConfig *RegistryConfig) map[string]string {
+	return map[string]string{
+		"endpoint":  registryConfig.Config.Endpoint,
+		"bucket":    registryConfig.Config.Bucket,
+		"accessKey": registryConfig.Config.AccessKey,
+		"secretKey": registryConfig.Config.SecretKey,
+		"projectID": registryConfig.Config.ProjectID,
+		"directory": registryConfig.Config.Directory,
+		"baseURL":   registryConfig.Config.BaseURL,
+	}
+}
+
+// Validate validates csctl.yaml, config.yaml and, if given or required by the build or mirror method, registry.yaml
+// of the cluster stack. It reports all problems at once in a ValidationError. Problems which do not prevent creating
+// node images, like unknown fields, are returned as warnings.
+func Validate(clusterStackPath, registryConfigPath string) ([]Problem, error) {
+	v := &validator{}
+
+	method, templateData := v.validateCsctlConfig(clusterStackPath)
+	v.validateConfig(clusterStackPath, method, templateData)
+
+	switch {
+	case registryConfigPath != "":
+		v.validateRegistryConfig(registryConfigPath)
+	case method == MethodBuild, method == MethodMirror:
+		v.problems = append(v.problems, Problem{
+			File:    filepath.Join(clusterStackPath, "csctl.yaml"),
+			Message: fmt.Sprintf("node image registry config is required when using the %s method", method),
+		})
+	}
+
+	return v.warnings, v.err()
+}
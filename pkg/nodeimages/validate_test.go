@@ -0,0 +1,152 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateUnknownFields(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		out          interface{}
+		wantWarnings []string
+	}{
+		{
+			name: "no unknown fields",
+			data: `apiVersion: v1
+openStackNodeImages:
+  - url: https://example.com/ubuntu.qcow2
+    createOpts:
+      name: ubuntu
+      disk_format: qcow2
+      container_format: bare
+`,
+			out: &NodeImages{},
+		},
+		{
+			name: "unknown fields at all levels",
+			data: `apiVersion: v1
+foo: 1
+openStackNodeImages:
+  - url: https://example.com/ubuntu.qcow2
+    createOpts:
+      name: ubuntu
+      visibilty: public
+      bar:
+        baz: 1
+      disk_format: qcow2
+      container_format: bare
+  - url: https://example.com/flatcar.qcow2
+    imagedir: flatcar
+    createOpts:
+      name: flatcar
+      disk_format: qcow2
+      container_format: bare
+`,
+			out: &NodeImages{},
+			wantWarnings: []string{
+				`config.yaml:2:1: unknown field "foo"`,
+				`config.yaml:7:7: unknown field "visibilty"`,
+				`config.yaml:8:7: unknown field "bar"`,
+				`config.yaml:13:5: unknown field "imagedir"`,
+			},
+		},
+		{
+			name: "registry config",
+			data: `type: S3
+config:
+  endpoint: s3.example.com
+  bucket: images
+  acessKey: key
+`,
+			out:          &RegistryConfig{},
+			wantWarnings: []string{`config.yaml:5:3: unknown field "acessKey"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &validator{}
+			if !v.decodeStrict(newYAMLSource("config.yaml", []byte(tt.data)), []byte(tt.data), tt.out) {
+				t.Fatalf("decoding failed: %v", v.problems)
+			}
+			var warnings []string
+			for _, warning := range v.warnings {
+				warnings = append(warnings, warning.String())
+			}
+			if !reflect.DeepEqual(warnings, tt.wantWarnings) {
+				t.Errorf("warnings are %q, want %q", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestValidateConfigNames(t *testing.T) {
+	const config = `apiVersion: v1
+openStackNodeImages:
+  - url: https://example.com/ubuntu.qcow2
+    createOpts:
+      name: NAME
+      disk_format: qcow2
+      container_format: bare
+  - url: https://example.com/flatcar.qcow2
+    createOpts:
+      name: flatcar
+      disk_format: qcow2
+      container_format: bare
+`
+
+	tests := []struct {
+		name      string
+		method    string
+		imageName string
+		wantErr   string
+	}{
+		{name: "name with slash", method: MethodGet, imageName: "ubuntu/v1.30.2"},
+		{name: "duplicate name", method: MethodGet, imageName: "flatcar"},
+		{name: "mirror", method: MethodMirror, imageName: "ubuntu"},
+		{name: "mirror name with slash", method: MethodMirror, imageName: "ubuntu/v1.30.2", wantErr: `config.yaml:5:13: field 'name' "ubuntu/v1.30.2" in CreateOpts must not contain '/'`},
+		{name: "mirror rendered name with slash", method: MethodMirror, imageName: `"ubuntu/{{ .KubernetesVersion }}"`, wantErr: `config.yaml:5:13: field 'name' "ubuntu/v1.30.2" in CreateOpts must not contain '/'`},
+		{name: "mirror duplicate name", method: MethodMirror, imageName: "flatcar", wantErr: `config.yaml:10:13: duplicate node image name "flatcar"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusterStackPath := t.TempDir()
+			configPath := filepath.Join(clusterStackPath, "node-images", "config.yaml")
+			if err := os.MkdirAll(filepath.Dir(configPath), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(configPath, []byte(strings.Replace(config, "NAME", tt.imageName, 1)), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			v := &validator{}
+			v.validateConfig(clusterStackPath, tt.method, &TemplateData{KubernetesVersion: "v1.30.2"})
+			err := v.err()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validation failed: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validation returned %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	errURLUnreachable   = errors.New("node image URL is not reachable")
+	errEmptyImage       = errors.New("node image is empty")
+	errChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// URLVerifier verifies that the URLs of node images are reachable.
+type URLVerifier struct {
+	// Client is the HTTP client used for the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+	// VerifyChecksum downloads every node image with a checksum and compares the checksums.
+	VerifyChecksum bool
+	// Cache stores the downloaded node images, so they are not downloaded again. It is optional.
+	Cache *Cache
+}
+
+// Verify verifies that the URL of the node image is reachable and not empty. If VerifyChecksum is set
+// and the node image has a checksum, the image is downloaded and its checksums are verified.
+func (v *URLVerifier) Verify(ctx context.Context, image *OpenStackNodeImage) error {
+	size, err := v.contentLength(ctx, image.URL)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return fmt.Errorf("%w: %s", errEmptyImage, image.URL)
+	}
+
+	if !v.VerifyChecksum || image.Checksum == nil {
+		return nil
+	}
+	return v.verifyChecksum(ctx, image.URL, image.Checksum)
+}
+
+func (v *URLVerifier) client() *http.Client {
+	if v.Client != nil {
+		return v.Client
+	}
+	return http.DefaultClient
+}
+
+// contentLength returns the content length of the URL. It sends a HEAD request and falls back to
+// a GET request of the first byte if the server does not support HEAD or omits the content length.
+// It returns -1 if the content length is unknown.
+func (v *URLVerifier) contentLength(ctx context.Context, url string) (int64, error) {
+	resp, err := v.do(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 && resp.ContentLength >= 0 {
+		return resp.ContentLength, nil
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return 0, fmt.Errorf("%w: %s: %s", errURLUnreachable, url, resp.Status)
+	}
+
+	resp, err = v.do(ctx, http.MethodGet, url, map[string]string{"Range": "bytes=0-0"})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/<size>
+		_, total, found := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if size, err := strconv.ParseInt(total, 10, 64); found && err == nil {
+			return size, nil
+		}
+		return -1, nil
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	default:
+		return 0, fmt.Errorf("%w: %s: %s", errURLUnreachable, url, resp.Status)
+	}
+}
+
+// verifyChecksum downloads the URL and compares the checksums of the content with the expected checksums.
+func (v *URLVerifier) verifyChecksum(ctx context.Context, url string, expected *Checksum) error {
+	if v.Cache != nil {
+		_, _, err := v.Cache.Download(ctx, v.client(), url, expected)
+		return err
+	}
+
+	resp, err := v.do(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s: %s", errURLUnreachable, url, resp.Status)
+	}
+
+	reader := newChecksumReader(resp.Body)
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return fmt.Errorf("error downloading %s: %w", url, err)
+	}
+	return compareChecksums(url, expected, reader.checksum())
+}
+
+func (v *URLVerifier) do(ctx context.Context, method, url string, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for %s: %w", url, err)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := v.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errURLUnreachable, err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testImageContent = "node image content"
+
+// newTestImageServer serves testImageContent. If headNotAllowed is set, HEAD requests are rejected like by
+// some object storages, so the verifier has to fall back to a range request.
+func newTestImageServer(t *testing.T, headNotAllowed bool) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/empty":
+			w.Header().Set("Content-Range", "bytes */0")
+			w.WriteHeader(http.StatusOK)
+		case req.URL.Path != "/image":
+			w.WriteHeader(http.StatusNotFound)
+		case req.Method == http.MethodHead && headNotAllowed:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case req.Header.Get("Range") == "bytes=0-0":
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-0/%d", len(testImageContent)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte(testImageContent[:1]))
+		default:
+			_, _ = w.Write([]byte(testImageContent))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testImageChecksum(t *testing.T) *Checksum {
+	t.Helper()
+	reader := newChecksumReader(strings.NewReader(testImageContent))
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Fatalf("error computing checksum: %v", err)
+	}
+	return reader.checksum()
+}
+
+func TestURLVerifierVerify(t *testing.T) {
+	checksum := testImageChecksum(t)
+	wrongChecksum := &Checksum{SHA256: strings.Repeat("0", 64)}
+
+	tests := []struct {
+		name           string
+		headNotAllowed bool
+		path           string
+		verifyChecksum bool
+		checksum       *Checksum
+		cache          bool
+		wantErr        error
+	}{
+		{name: "head", path: "/image"},
+		{name: "range fallback", headNotAllowed: true, path: "/image"},
+		{name: "not found", path: "/missing", wantErr: errURLUnreachable},
+		{name: "not found with range fallback", headNotAllowed: true, path: "/missing", wantErr: errURLUnreachable},
+		{name: "empty", path: "/empty", wantErr: errEmptyImage},
+		{name: "checksum", path: "/image", verifyChecksum: true, checksum: checksum},
+		{name: "checksum mismatch", path: "/image", verifyChecksum: true, checksum: wrongChecksum, wantErr: errChecksumMismatch},
+		{name: "checksum mismatch ignored", path: "/image", checksum: wrongChecksum},
+		{name: "checksum with cache", path: "/image", verifyChecksum: true, checksum: checksum, cache: true},
+		{name: "checksum mismatch with cache", path: "/image", verifyChecksum: true, checksum: wrongChecksum, cache: true, wantErr: errChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestImageServer(t, tt.headNotAllowed)
+			verifier := &URLVerifier{Client: server.Client(), VerifyChecksum: tt.verifyChecksum}
+			if tt.cache {
+				verifier.Cache = NewCache(t.TempDir(), 0)
+			}
+
+			image := &OpenStackNodeImage{URL: server.URL + tt.path, Checksum: tt.checksum}
+			err := verifier.Verify(context.Background(), image)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestURLVerifierContentLength(t *testing.T) {
+	for _, headNotAllowed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("headNotAllowed=%t", headNotAllowed), func(t *testing.T) {
+			server := newTestImageServer(t, headNotAllowed)
+			verifier := &URLVerifier{Client: server.Client()}
+			size, err := verifier.contentLength(context.Background(), server.URL+"/image")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if size != int64(len(testImageContent)) {
+				t.Errorf("content length is %d, want %d", size, len(testImageContent))
+			}
+		})
+	}
+}
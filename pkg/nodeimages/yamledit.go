@@ -0,0 +1,334 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+	"github.com/goccy/go-yaml/token"
+)
+
+var errNotBlockMapping = errors.New("only block style mappings can be updated")
+
+// yamlEdit replaces the bytes between start and end of the YAML data with text.
+type yamlEdit struct {
+	start, end int
+	text       string
+	// order is the position of the edit in the list of edits. Inserts at the same offset are applied in this order.
+	order int
+}
+
+// yamlEditor edits YAML data in place. The nodes are located with the AST of the data, but only the text of
+// changed values is replaced, so comments, formatting and unknown fields are kept.
+type yamlEditor struct {
+	data       []byte
+	file       *ast.File
+	lineStarts []int
+	edits      []yamlEdit
+}
+
+func newYAMLEditor(data []byte) (*yamlEditor, error) {
+	file, err := parser.ParseBytes(data, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	lineStarts := []int{0}
+	for i, b := range data {
+		if b == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	return &yamlEditor{data: data, file: file, lineStarts: lineStarts}, nil
+}
+
+// updateYAML changes the mapping at the YAML path from before to after and returns the edited data.
+// Only the values which differ are replaced and keys missing in the data are appended to the mapping.
+// Keys which are only in before are kept.
+func updateYAML(data []byte, yamlPath string, before, after yaml.MapSlice) ([]byte, error) {
+	if reflect.DeepEqual(before, after) {
+		return data, nil
+	}
+	editor, err := newYAMLEditor(data)
+	if err != nil {
+		return nil, err
+	}
+	path, err := yaml.PathString(yamlPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid YAML path %s: %w", yamlPath, err)
+	}
+	node, err := path.FilterFile(editor.file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %s: %w", yamlPath, err)
+	}
+	if err := editor.updateMapping(node, before, after); err != nil {
+		return nil, fmt.Errorf("failed to update %s: %w", yamlPath, err)
+	}
+	return editor.apply(), nil
+}
+
+// toMapSlice converts the value to an ordered YAML mapping as it would be marshaled.
+func toMapSlice(value interface{}) (yaml.MapSlice, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal YAML: %w", err)
+	}
+	var mapSlice yaml.MapSlice
+	if err := yaml.UnmarshalWithOptions(data, &mapSlice, yaml.UseOrderedMap()); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal YAML: %w", err)
+	}
+	return mapSlice, nil
+}
+
+// updateMapping records the edits which change the values of the block mapping node from before to after.
+func (e *yamlEditor) updateMapping(node ast.Node, before, after yaml.MapSlice) error {
+	values, ok := blockMappingValues(node)
+	if !ok || len(values) == 0 {
+		return errNotBlockMapping
+	}
+
+	var inserts yaml.MapSlice
+	for _, item := range after {
+		key := fmt.Sprint(item.Key)
+		beforeValue, inBefore := lookupMapSlice(before, key)
+		if inBefore && reflect.DeepEqual(beforeValue, item.Value) {
+			continue
+		}
+
+		mappingValue := findMappingValue(values, key)
+		if mappingValue == nil {
+			inserts = append(inserts, item)
+			continue
+		}
+
+		// Update nested mappings key by key, so the unchanged keys keep their formatting
+		afterMapping, afterIsMapping := item.Value.(yaml.MapSlice)
+		beforeMapping, beforeIsMapping := beforeValue.(yaml.MapSlice)
+		if afterIsMapping && beforeIsMapping {
+			if _, ok := blockMappingValues(mappingValue.Value); ok {
+				if err := e.updateMapping(mappingValue.Value, beforeMapping, afterMapping); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if err := e.replaceValue(mappingValue, item.Value); err != nil {
+			return err
+		}
+	}
+
+	if len(inserts) > 0 {
+		return e.insert(node, values[0], inserts)
+	}
+	return nil
+}
+
+// replaceValue records the edit which replaces the value of the mapping value node. A scalar on the line of the key
+// is replaced in place, keeping a trailing comment, otherwise the whole entry is rendered again.
+func (e *yamlEditor) replaceValue(mappingValue *ast.MappingValueNode, value interface{}) error {
+	keyToken := mappingValue.Key.GetToken()
+	valueToken := mappingValue.Value.GetToken()
+	if _, isScalar := mappingValue.Value.(ast.ScalarNode); isScalar && isScalarValue(value) &&
+		mappingValue.Value.Type() != ast.NullType && valueToken.Position.Line == keyToken.Position.Line {
+		text := strings.TrimSpace(valueToken.Origin)
+		start, err := e.offset(valueToken.Position.Line, valueToken.Position.Column)
+		if err != nil {
+			return err
+		}
+		if text != "" && !strings.Contains(text, "\n") && bytes.HasPrefix(e.data[start:], []byte(text)) {
+			rendered, err := yaml.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("failed to marshal YAML: %w", err)
+			}
+			e.addEdit(start, start+len(text), strings.TrimSuffix(string(rendered), "\n"))
+			return nil
+		}
+	}
+
+	start, err := e.offset(keyToken.Position.Line, keyToken.Position.Column)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(e.data[start:], []byte(mappingValue.Key.String())) {
+		return fmt.Errorf("failed to locate key %s in line %d", mappingValue.Key, keyToken.Position.Line)
+	}
+	text, err := renderMapping(yaml.MapSlice{{Key: mappingValue.Key.String(), Value: value}}, keyToken.Position.Column-1)
+	if err != nil {
+		return err
+	}
+	// The key is already indented in the data
+	text = strings.TrimLeft(text, " ")
+	end := e.lineEnd(lastLine(mappingValue))
+	if end == len(e.data) && !bytes.HasSuffix(e.data, []byte("\n")) {
+		text = strings.TrimSuffix(text, "\n")
+	}
+	e.addEdit(start, end, text)
+	return nil
+}
+
+// insert records the edit which appends the items to the end of the block mapping node.
+// The items are indented like the first key of the mapping.
+func (e *yamlEditor) insert(node ast.Node, first *ast.MappingValueNode, items yaml.MapSlice) error {
+	text, err := renderMapping(items, first.Key.GetToken().Position.Column-1)
+	if err != nil {
+		return err
+	}
+	end := e.lineEnd(lastLine(node))
+	if end == len(e.data) && !bytes.HasSuffix(e.data, []byte("\n")) {
+		text = "\n" + strings.TrimSuffix(text, "\n")
+	}
+	e.addEdit(end, end, text)
+	return nil
+}
+
+func (e *yamlEditor) addEdit(start, end int, text string) {
+	e.edits = append(e.edits, yamlEdit{start: start, end: end, text: text, order: len(e.edits)})
+}
+
+// apply returns the data with all recorded edits applied.
+func (e *yamlEditor) apply() []byte {
+	edits := append([]yamlEdit(nil), e.edits...)
+	// Apply the edits from the end of the data, so the offsets of the remaining edits stay valid
+	sort.Slice(edits, func(i, j int) bool {
+		if edits[i].start != edits[j].start {
+			return edits[i].start > edits[j].start
+		}
+		return edits[i].order > edits[j].order
+	})
+
+	data := append([]byte(nil), e.data...)
+	for _, edit := range edits {
+		data = append(data[:edit.start], append([]byte(edit.text), data[edit.end:]...)...)
+	}
+	return data
+}
+
+// offset returns the offset of the 1-based line and column in the data.
+func (e *yamlEditor) offset(line, column int) (int, error) {
+	if line < 1 || line > len(e.lineStarts) {
+		return 0, fmt.Errorf("invalid line %d", line)
+	}
+	offset := e.lineStarts[line-1] + column - 1
+	if column < 1 || offset > len(e.data) {
+		return 0, fmt.Errorf("invalid column %d in line %d", column, line)
+	}
+	return offset, nil
+}
+
+// lineEnd returns the offset after the newline of the 1-based line.
+func (e *yamlEditor) lineEnd(line int) int {
+	if line >= len(e.lineStarts) {
+		return len(e.data)
+	}
+	return e.lineStarts[line]
+}
+
+// renderMapping marshals the items as block mapping indented by the given number of spaces.
+func renderMapping(items yaml.MapSlice, indent int) (string, error) {
+	data, err := yaml.MarshalWithOptions(items, yaml.Indent(2), yaml.IndentSequence(true))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal YAML: %w", err)
+	}
+	prefix := strings.Repeat(" ", indent)
+	var builder strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line != "" {
+			builder.WriteString(prefix + line)
+		}
+	}
+	return builder.String(), nil
+}
+
+// blockMappingValues returns the values of the node if it is a block style mapping.
+func blockMappingValues(node ast.Node) ([]*ast.MappingValueNode, bool) {
+	switch n := node.(type) {
+	case *ast.MappingNode:
+		return n.Values, !n.IsFlowStyle
+	case *ast.MappingValueNode:
+		// A mapping with a single key is parsed as mapping value
+		return []*ast.MappingValueNode{n}, true
+	}
+	return nil, false
+}
+
+func findMappingValue(values []*ast.MappingValueNode, key string) *ast.MappingValueNode {
+	for _, value := range values {
+		if value.Key.String() == key {
+			return value
+		}
+	}
+	return nil
+}
+
+func lookupMapSlice(mapSlice yaml.MapSlice, key string) (interface{}, bool) {
+	for _, item := range mapSlice {
+		if fmt.Sprint(item.Key) == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+func isScalarValue(value interface{}) bool {
+	switch value.(type) {
+	case yaml.MapSlice, []interface{}, nil:
+		return false
+	}
+	return true
+}
+
+// lastLineVisitor finds the last line of the tokens of a node, ignoring comments.
+type lastLineVisitor struct {
+	line *int
+}
+
+func (v lastLineVisitor) Visit(node ast.Node) ast.Visitor {
+	if node.Type() == ast.CommentType {
+		return nil
+	}
+	v.add(node.GetToken())
+	switch n := node.(type) {
+	case *ast.MappingNode:
+		v.add(n.End)
+	case *ast.SequenceNode:
+		v.add(n.End)
+	}
+	return v
+}
+
+func (v lastLineVisitor) add(tk *token.Token) {
+	if tk == nil {
+		return
+	}
+	// Multi-line scalars span the lines of their origin
+	line := tk.Position.Line + strings.Count(strings.TrimSpace(tk.Origin), "\n")
+	if line > *v.line {
+		*v.line = line
+	}
+}
+
+// lastLine returns the last line of the node.
+func lastLine(node ast.Node) int {
+	line := 0
+	ast.Walk(lastLineVisitor{line: &line}, node)
+	return line
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodeimages
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	yaml "github.com/goccy/go-yaml"
+)
+
+// editNodeImage applies the update to the first node image of the data like updateNodeImage does with a file.
+func editNodeImage(data string, update func(image *OpenStackNodeImage)) (string, error) {
+	var nodeImages NodeImages
+	if err := yaml.Unmarshal([]byte(data), &nodeImages); err != nil {
+		return "", err
+	}
+	if len(nodeImages.OpenStackNodeImages) == 0 {
+		return "", fmt.Errorf("no node images in data")
+	}
+	image := nodeImages.OpenStackNodeImages[0]
+	before, err := toMapSlice(image)
+	if err != nil {
+		return "", err
+	}
+	update(image)
+	after, err := toMapSlice(image)
+	if err != nil {
+		return "", err
+	}
+	edited, err := updateYAML([]byte(data), "$.openStackNodeImages[0]", before, after)
+	return string(edited), err
+}
+
+func TestUpdateYAML(t *testing.T) {
+	setURL := func(image *OpenStackNodeImage) { image.URL = "https://example.com/new.qcow2" }
+
+	tests := []struct {
+		name   string
+		data   string
+		update func(image *OpenStackNodeImage)
+		want   string
+	}{
+		{
+			name: "insert missing key",
+			data: `openStackNodeImages:
+  - imageDir: ubuntu
+    # the name is rendered
+    createOpts:
+      name: ubuntu-{{ .KubernetesVersion }}
+    unknown: kept
+`,
+			update: setURL,
+			want: `openStackNodeImages:
+  - imageDir: ubuntu
+    # the name is rendered
+    createOpts:
+      name: ubuntu-{{ .KubernetesVersion }}
+    unknown: kept
+    url: https://example.com/new.qcow2
+`,
+		},
+		{
+			name: "insert missing nested key",
+			data: `openStackNodeImages:
+  - url: https://example.com/ubuntu.qcow2
+    createOpts:
+      name: ubuntu
+`,
+			update: func(image *OpenStackNodeImage) { image.CreateOpts.MinDisk = 20 },
+			want: `openStackNodeImages:
+  - url: https://example.com/ubuntu.qcow2
+    createOpts:
+      name: ubuntu
+      min_disk: 20
+`,
+		},
+		{
+			name: "null value",
+			data: `openStackNodeImages:
+  - url: null
+    createOpts:
+      name: ubuntu
+`,
+			update: setURL,
+			want: `openStackNodeImages:
+  - url: https://example.com/new.qcow2
+    createOpts:
+      name: ubuntu
+`,
+		},
+		{
+			name: "empty value",
+			data: `openStackNodeImages:
+  - url:
+    createOpts:
+      name: ubuntu
+`,
+			update: setURL,
+			want: `openStackNodeImages:
+  - url: https://example.com/new.qcow2
+    createOpts:
+      name: ubuntu
+`,
+		},
+		{
+			name: "quoted value with trailing comment",
+			data: `openStackNodeImages:
+  - url: "https://example.com/old.qcow2" # replaced by the build
+    createOpts:
+      name: ubuntu
+`,
+			update: setURL,
+			want: `openStackNodeImages:
+  - url: https://example.com/new.qcow2 # replaced by the build
+    createOpts:
+      name: ubuntu
+`,
+		},
+		{
+			name: "comments after last key",
+			data: `openStackNodeImages:
+  - createOpts:
+      name: ubuntu
+    # url is set by the build
+# end of node images
+`,
+			update: setURL,
+			want: `openStackNodeImages:
+  - createOpts:
+      name: ubuntu
+    url: https://example.com/new.qcow2
+    # url is set by the build
+# end of node images
+`,
+		},
+		{
+			name: "insert without trailing newline",
+			data: `openStackNodeImages:
+  - createOpts:
+      name: ubuntu`,
+			update: setURL,
+			want: `openStackNodeImages:
+  - createOpts:
+      name: ubuntu
+    url: https://example.com/new.qcow2`,
+		},
+		{
+			name: "replace without trailing newline",
+			data: `openStackNodeImages:
+  - createOpts:
+      name: ubuntu
+    url: https://example.com/old.qcow2`,
+			update: setURL,
+			want: `openStackNodeImages:
+  - createOpts:
+      name: ubuntu
+    url: https://example.com/new.qcow2`,
+		},
+		{
+			name: "unchanged",
+			data: `openStackNodeImages:
+  - url:   https://example.com/new.qcow2   # formatting is kept
+`,
+			update: setURL,
+			want: `openStackNodeImages:
+  - url:   https://example.com/new.qcow2   # formatting is kept
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := editNodeImage(tt.data, tt.update)
+			if err != nil {
+				t.Fatalf("update failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("updated YAML is\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteNodeImagesFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "config.yaml")
+	dest := filepath.Join(dir, "node-images.yaml")
+	if err := os.WriteFile(src, []byte(`# node images of the cluster stack
+openStackNodeImages:
+  - url: https://example.com/ubuntu.qcow2 # upstream image
+    createOpts:
+      name: ubuntu-{{ .KubernetesVersion }}
+    unknown: kept
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	nodeImages := &NodeImages{OpenStackNodeImages: []*OpenStackNodeImage{{
+		URL:        "https://mirror.example.com/ubuntu-v1.30.2",
+		CreateOpts: &CreateOpts{Name: "ubuntu-v1.30.2"},
+	}}}
+	if err := writeNodeImagesFile(src, dest, nodeImages); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	want := `# node images of the cluster stack
+openStackNodeImages:
+  - url: https://mirror.example.com/ubuntu-v1.30.2 # upstream image
+    createOpts:
+      name: ubuntu-v1.30.2
+    unknown: kept
+`
+	if data, err := os.ReadFile(dest); err != nil || string(data) != want {
+		t.Errorf("node-images.yaml is\n%s\n(%v), want\n%s", data, err, want)
+	}
+}